@@ -18,17 +18,36 @@ import (
 
 const translationFile = "translation.json"
 
-// for passing MQTT set commands via channel
+// for passing MQTT set commands via channel; a message may carry several
 type aquareaCommand struct {
 	deviceID string
 	setting  string
 	value    string
+	request  *mqttRequest // MQTT v5 command to answer, nil if no response is wanted
 }
 type aquareaFunctionDescription struct {
-	Name          string            `json:"name"`
-	Kind          string            `json:"kind"`
-	Values        map[string]string `json:"values"`
-	reverseValues map[string]string
+	Name   string            `json:"name"`
+	Kind   string            `json:"kind"`
+	Values map[string]string `json:"values"`
+	Min    *int              `json:"min"` // range of placeholder values
+	Max    *int              `json:"max"`
+	Step   int               `json:"step"`
+	Unit   string            `json:"unit"`
+	Button *aquareaButton    `json:"button"` // one-shot request rather than a setting
+	Energy string            `json:"energy"` // log item in kW per interval: name of the kWh counter integrated from it
+
+	// Home Assistant semantics of a status item
+	DeviceClass    string `json:"device_class"`
+	StateClass     string `json:"state_class"`
+	EntityCategory string `json:"entity_category"`
+}
+
+// Status item showing whether a requested action is running, and its labels.
+// Without a status item, the setting itself tells.
+type aquareaButton struct {
+	Status string `json:"status"`
+	On     string `json:"on"`
+	Off    string `json:"off"`
 }
 
 type aquareaLogItem struct {
@@ -42,20 +61,31 @@ type aquarea struct {
 	AquareaServiceCloudLogin    string
 	AquareaServiceCloudPassword string
 	logSecOffset                int64
-	dataChannel                 chan map[string]string
-	statusChannel               chan bool
+	confirmTimeout              time.Duration
+	confirmInterval             time.Duration
+	confirmations               []*settingConfirmation // accepted requests, waiting for the device
+	errorHistoryLength          int
+	pipeline                    *pipeline // to the MQTT handler
 
-	httpClient             http.Client
-	dictionaryWebUI        map[string]string                      // xxxx-yyyy codes translation to messages
-	reverseDictionaryWebUI map[string]string                      // message to xxxx-yyyy code translation
-	usersMap               map[string]aquareaEndUserJSON          // list of users (devices) linked to an account
-	translation            map[string]*aquareaFunctionDescription // function name meaning
-	reverseTranslation     map[string]string                      // map of friendly names to Aquarea meaningless ones
-	logItems               []aquareaLogItem                       // table with names of log items (statistics view)
-	aquareaSettings        aquareaFunctionSettingGetJSON          // needs be cached, contains info relevant for changing settings
+	httpClient         http.Client
+	dictionaryWebUI    map[string]string                        // xxxx-yyyy codes translation to messages
+	usersMap           map[string]aquareaEndUserJSON            // list of users (devices) linked to an account
+	translation        map[string]*aquareaFunctionDescription   // function name meaning
+	reverseTranslation map[string]string                        // map of friendly names to Aquarea meaningless ones
+	logItems           []aquareaLogItem                         // table with names of log items (statistics view)
+	aquareaSettings    map[string]aquareaFunctionSettingGetJSON // per device (Gwid), contains info relevant for changing settings
+	session            aquareaSession                           // Service Cloud login state
+	errorHistory       map[string]map[string]bool               // per device (Gwid), error history entries already reported
+	errorCodes         map[string]aquareaErrorCodeDescription   // error code catalogue
+	settingValues      map[string]aquareaSettingValues          // per device (Gwid), settings as last read, for command responses
+	energyCounters     map[string]*energyCounter                // per device (Gwid) and log item, energy integrated from power
+	pendingSettings    map[string]string                        // settings changed by commands being expanded, friendly name to value
+
+	installerShiesuahruefutohkun string // from installer home, for the device list
+	topics                       *topicLayout
 }
 
-func aquareaHandler(ctx context.Context, wg *sync.WaitGroup, config configType, dataChannel chan map[string]string, commandChannel chan aquareaCommand, statusChannel chan bool) {
+func aquareaHandler(ctx context.Context, wg *sync.WaitGroup, config configType, dataPipeline *pipeline, commands *commandQueue) {
 	defer wg.Done()
 	log.Println("Starting Aquarea Service Cloud handler")
 	var aquareaInstance aquarea
@@ -63,11 +93,23 @@ func aquareaHandler(ctx context.Context, wg *sync.WaitGroup, config configType,
 	aquareaInstance.AquareaServiceCloudLogin = config.AquareaServiceCloudLogin
 	aquareaInstance.AquareaServiceCloudPassword = config.AquareaServiceCloudPassword
 	aquareaInstance.logSecOffset = config.LogSecOffset
-	aquareaInstance.dataChannel = dataChannel
-	aquareaInstance.statusChannel = statusChannel
+	aquareaInstance.confirmTimeout = parseDurationDefault(config.SettingConfirmTimeout, 60*time.Second)
+	aquareaInstance.confirmInterval = parseDurationDefault(config.SettingConfirmInterval, 5*time.Second)
+	aquareaInstance.errorHistoryLength = config.ErrorHistoryLength
+	if aquareaInstance.errorHistoryLength <= 0 {
+		aquareaInstance.errorHistoryLength = 10
+	}
+	aquareaInstance.pipeline = dataPipeline
+	aquareaInstance.topics = newTopicLayout(config)
 	aquareaInstance.usersMap = make(map[string]aquareaEndUserJSON)
+	aquareaInstance.aquareaSettings = make(map[string]aquareaFunctionSettingGetJSON)
+	aquareaInstance.settingValues = make(map[string]aquareaSettingValues)
+	aquareaInstance.session = newAquareaSession()
+	aquareaInstance.errorHistory = make(map[string]map[string]bool)
+	aquareaInstance.energyCounters = make(map[string]*energyCounter)
 
 	aquareaInstance.loadTranslations(translationFile)
+	aquareaInstance.loadErrorCodes(errorCodesFile, config.ErrorCodesFile)
 
 	poolInterval, err := time.ParseDuration(config.PoolInterval)
 	if err != nil {
@@ -78,31 +120,247 @@ func aquareaHandler(ctx context.Context, wg *sync.WaitGroup, config configType,
 	if err != nil {
 		log.Fatal(err)
 	}
+	var transport http.RoundTripper = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	if config.AquareaReplayDir != "" {
+		log.Printf("Replaying Aquarea Service Cloud traffic from %s", config.AquareaReplayDir)
+		transport, err = newReplayTransport(config.AquareaReplayDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if config.AquareaRecordDir != "" {
+		log.Printf("Recording Aquarea Service Cloud traffic to %s", config.AquareaRecordDir)
+		transport, err = newRecordingTransport(transport, config.AquareaRecordDir, config.AquareaServiceCloudLogin, config.AquareaServiceCloudPassword)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	cookieJar, _ := cookiejar.New(nil)
 	aquareaInstance.httpClient = http.Client{
-		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		Transport: transport,
 		Jar:       cookieJar,
 		Timeout:   timeout,
 	}
 
 	log.Println("Attempting to log in to Aquarea Service Cloud")
-	for !aquareaInstance.aquareaSetup() {
-	}
-	log.Println("Logged in to Aquarea Service Cloud")
-
+	loginTimer := time.NewTimer(0)
+	defer loginTimer.Stop()
 	ticker := time.NewTicker(poolInterval)
+	defer ticker.Stop()
+	confirmTicker := time.NewTicker(aquareaInstance.confirmInterval)
+	defer confirmTicker.Stop()
 	for {
 		select {
+		case <-loginTimer.C:
+			if delay := aquareaInstance.login(); delay > 0 {
+				loginTimer.Reset(delay)
+			}
 		case <-ticker.C:
+			if !aquareaInstance.session.loggedIn() {
+				break
+			}
 			aquareaInstance.feedDataFromAquarea()
-		case command := <-commandChannel:
-			aquareaInstance.sendSetting(command)
+			if aquareaInstance.session.state == sessionLoggedOut {
+				// session expired - log in again right away, backoff applies if that fails
+				loginTimer.Reset(0)
+			}
+		case <-confirmTicker.C:
+			aquareaInstance.checkConfirmations()
+		case <-commands.notify:
+			for _, queued := range commands.take(time.Now()) {
+				aquareaInstance.respondToCommands(queued.supersededOnly(), settingSuperseded)
+				if !aquareaInstance.session.loggedIn() {
+					log.Printf("Not logged in, dropping commands for %s", queued.commands[0].deviceID)
+					for _, cmd := range queued.commands {
+						aquareaInstance.publishSettingResult(cmd, settingFailed)
+					}
+					aquareaInstance.respondToCommands(queued.commands, settingFailed)
+					continue
+				}
+				aquareaInstance.executeCommands(queued.commands)
+			}
 		case <-ctx.Done():
+			// final results, the MQTT handler publishes them after this one stopped
+			aquareaInstance.abandonConfirmations()
 			return
 		}
 	}
 }
 
+// Translates a command for a virtual setting into device setting commands.
+// Other commands are passed as they are.
+func (aq *aquarea) expandCommand(cmd aquareaCommand) ([]aquareaCommand, error) {
+	switch cmd.setting {
+	case hvacModeSetting:
+		return aq.expandHVACMode(cmd)
+	case dhwModeSetting:
+		return aq.expandDHWMode(cmd)
+	}
+	for _, zone := range climateZones {
+		if cmd.setting == fmt.Sprintf(zoneTargetSetting, zone) {
+			return aq.expandZoneTarget(cmd, zone), nil
+		}
+	}
+	return []aquareaCommand{cmd}, nil
+}
+
+// Runs queued commands of one device. Virtual settings are expanded and each MQTT message is
+// validated on its own: an invalid message is answered as such, the valid ones are sent together
+// in one request. A message whose changes are all replaced by later ones is superseded.
+func (aq *aquarea) executeCommands(commands []aquareaCommand) {
+	plan := aq.expandCommands(commands)
+	for _, invalid := range plan.invalid {
+		log.Println(invalid.err)
+		result := fmt.Sprintf("%s: %v", settingInvalid, invalid.err)
+		for _, cmd := range invalid.commands {
+			aq.publishSettingResult(cmd, result)
+		}
+		aq.respondToCommands(invalid.commands, result)
+	}
+	for _, cmd := range plan.superseded {
+		if !plan.sets(cmd.setting) {
+			// otherwise the result topic tells the outcome of the newer change
+			aq.publishSettingResult(cmd, settingSuperseded)
+		}
+	}
+	aq.respondToCommands(plan.superseded, settingSuperseded)
+	if len(plan.changes) == 0 {
+		return
+	}
+
+	result, err := aq.sendSettings(plan.changes)
+	if err != nil {
+		log.Println(err)
+	}
+	if result == settingAccepted {
+		// answered once the device reports the new values
+		aq.awaitConfirmation(plan.commands, plan.changes)
+		return
+	}
+	aq.respondToCommands(plan.commands, result)
+}
+
+// Commands sorted out before anything is sent
+type commandPlan struct {
+	changes    []aquareaSettingChange // one per device setting, for one request
+	commands   []aquareaCommand       // messages with changes in the request
+	superseded []aquareaCommand       // messages with all their changes replaced by later ones
+	invalid    []invalidMessage
+}
+
+type invalidMessage struct {
+	commands []aquareaCommand
+	err      error
+}
+
+// Whether the request changes a setting, or a command in it is about the setting
+func (plan *commandPlan) sets(setting string) bool {
+	for _, change := range plan.changes {
+		if change.cmd.setting == setting {
+			return true
+		}
+	}
+	for _, cmd := range plan.commands {
+		if cmd.setting == setting {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups commands by MQTT message: the settings of a bulk message go together, any other
+// command is a message of its own
+func commandMessages(commands []aquareaCommand) [][]aquareaCommand {
+	var messages [][]aquareaCommand
+	index := make(map[*mqttRequest]int)
+	for _, cmd := range commands {
+		if cmd.request != nil && cmd.request.bulk {
+			if i, ok := index[cmd.request]; ok {
+				messages[i] = append(messages[i], cmd)
+				continue
+			}
+			index[cmd.request] = len(messages)
+		}
+		messages = append(messages, []aquareaCommand{cmd})
+	}
+	return messages
+}
+
+// Expands and validates commands, each message as a whole. Each virtual setting sees device
+// settings as the valid commands before it leave them, so HVACMode and DHWMode can be combined;
+// for the same device setting the last command wins.
+func (aq *aquarea) expandCommands(commands []aquareaCommand) commandPlan {
+	aq.pendingSettings = make(map[string]string)
+	defer func() { aq.pendingSettings = nil }()
+
+	var plan commandPlan
+	var valid [][]aquareaCommand  // messages
+	var from []int                // message of each change
+	index := make(map[string]int) // function name to position in changes
+	for _, message := range commandMessages(commands) {
+		saved := make(map[string]string)
+		for k, v := range aq.pendingSettings {
+			saved[k] = v
+		}
+		changes, err := aq.expandMessage(message)
+		if err != nil {
+			aq.pendingSettings = saved
+			plan.invalid = append(plan.invalid, invalidMessage{message, err})
+			continue
+		}
+		for _, change := range changes {
+			if i, ok := index[change.functionName]; ok {
+				plan.changes[i] = change
+				from[i] = len(valid)
+			} else {
+				index[change.functionName] = len(plan.changes)
+				plan.changes = append(plan.changes, change)
+				from = append(from, len(valid))
+			}
+		}
+		valid = append(valid, message)
+	}
+
+	sent := make(map[int]bool)
+	for _, m := range from {
+		sent[m] = true
+	}
+	for m, message := range valid {
+		if sent[m] {
+			plan.commands = append(plan.commands, message...)
+		} else {
+			plan.superseded = append(plan.superseded, message...)
+		}
+	}
+	return plan
+}
+
+// Expands and validates the commands of one message
+func (aq *aquarea) expandMessage(message []aquareaCommand) ([]aquareaSettingChange, error) {
+	var changes []aquareaSettingChange
+	for _, command := range message {
+		if command.value == "----" {
+			continue
+		}
+		expanded, err := aq.expandCommand(command)
+		if err != nil {
+			return nil, err
+		}
+		for _, cmd := range expanded {
+			functionName, value, err := aq.validateSetting(cmd)
+			if err != nil {
+				return nil, err
+			}
+			aq.pendingSettings[cmd.setting] = cmd.value
+			changes = append(changes, aquareaSettingChange{cmd, functionName, value})
+		}
+	}
+	if len(changes) == 0 {
+		return nil, fmt.Errorf("Nothing to set, ---- is a placeholder")
+	}
+	return changes, nil
+}
+
 func (aq *aquarea) loadTranslations(filename string) {
 	// Load JSON with translations from Aquarea cryptic names
 	data, err := ioutil.ReadFile(filename)
@@ -114,14 +372,6 @@ func (aq *aquarea) loadTranslations(filename string) {
 		log.Fatal(err)
 	}
 
-	// add reverse Value translation
-	for kDescr, descr := range aq.translation {
-		aq.translation[kDescr].reverseValues = make(map[string]string)
-		for k, v := range descr.Values {
-			descr.reverseValues[v] = k
-		}
-	}
-
 	// create reverse map i.e. aquareaFunctionDescription.Name to key
 	aq.reverseTranslation = make(map[string]string)
 	for key, value := range aq.translation {
@@ -133,42 +383,130 @@ func (aq *aquarea) loadTranslations(filename string) {
 	}
 }
 
+// Polls all devices. Updates session state: an expired session means logged out,
+// partial data means degraded.
 func (aq *aquarea) feedDataFromAquarea() {
+	degraded := false
+	fetched := make(map[string]bool)
+	if changed, err := aq.updateEndUsers(); err != nil {
+		log.Println(err)
+		degraded = true
+	} else if changed {
+		// devices added to or removed from the account: new discovery, stale configs go
+		log.Println("Devices linked to the account changed")
+		fetched = aq.aquareaInitialFetch()
+	}
+	aq.pipeline.publish(aq.deviceAvailability())
+	aq.pipeline.publish(aq.currentErrors())
+
 	for _, user := range aq.usersMap {
+		if !deviceOnline(user) {
+			// nothing to fetch, availability tells it is offline
+			continue
+		}
+		if fetched[user.Gwid] {
+			// read by the initial fetch just now
+			continue
+		}
 		// Get settings from the device
 		shiesuahruefutohkun, err := aq.getEndUserShiesuahruefutohkun(user)
 		if err != nil {
-			aq.statusChannel <- false
 			log.Println(err)
 			log.Println("Will attempt to log in again")
-			// try to log in again
-			aq.aquareaSetup()
-			continue
+			aq.setSessionState(sessionLoggedOut)
+			return
 		}
 
 		settings, err := aq.getDeviceSettings(user, shiesuahruefutohkun)
 		if err != nil {
 			log.Println(err)
+			degraded = true
 		} else {
-			aq.dataChannel <- settings
+			aq.pipeline.publish(settings)
+			aq.resolveConfirmations(user.Gwid)
 		}
 
 		// Send device status
 		deviceStatus, err := aq.parseDeviceStatus(user, shiesuahruefutohkun)
 		if err != nil {
 			log.Println(err)
+			degraded = true
 		} else {
-			aq.dataChannel <- deviceStatus
+			aq.pipeline.publish(deviceStatus)
 		}
 
 		// Send device logs
 		logData, err := aq.getDeviceLogInformation(user, shiesuahruefutohkun)
 		if err != nil {
 			log.Println(err)
+			degraded = true
 		} else {
-			aq.dataChannel <- logData
+			aq.pipeline.publish(logData)
+		}
+	}
+
+	if degraded {
+		aq.setSessionState(sessionDegraded)
+	} else {
+		aq.setSessionState(sessionReady)
+	}
+}
+
+// Refreshes connection, power and error of the devices, adding and removing devices
+// linked to the account since the last read. Tells whether the set of devices changed.
+func (aq *aquarea) updateEndUsers() (bool, error) {
+	endUsers, err := aq.getEndUsers()
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	current := make(map[string]bool)
+	for _, user := range endUsers {
+		current[user.Gwid] = true
+		if _, ok := aq.usersMap[user.Gwid]; !ok {
+			log.Println("Device added:", user.Gwid)
+			changed = true
+		}
+		aq.usersMap[user.Gwid] = user
+	}
+	for gwid := range aq.usersMap {
+		if !current[gwid] {
+			log.Println("Device removed:", gwid)
+			aq.pipeline.publish(map[string]string{aq.topics.device(gwid, topicStatus): "offline"})
+			delete(aq.usersMap, gwid)
+			delete(aq.aquareaSettings, gwid)
+			delete(aq.settingValues, gwid)
+			// a device linked again starts over as on its first fetch
+			delete(aq.errorHistory, gwid)
+			for key := range aq.energyCounters {
+				if strings.HasPrefix(key, gwid+"/") {
+					delete(aq.energyCounters, key)
+				}
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+func deviceOnline(user aquareaEndUserJSON) bool {
+	return strings.EqualFold(user.Connection, "Online")
+}
+
+// Per device availability for Home Assistant, and power as the device list reports it
+func (aq *aquarea) deviceAvailability() map[string]string {
+	availability := make(map[string]string)
+	for _, user := range aq.usersMap {
+		status := "offline"
+		if deviceOnline(user) {
+			status = "online"
+		}
+		availability[aq.topics.device(user.Gwid, topicStatus)] = status
+		if user.Power != "" {
+			availability[aq.topics.device(user.Gwid, topicStatus, "power")] = user.Power
 		}
 	}
+	return availability
 }
 
 func (aq *aquarea) getShiesuahruefutohkun(url string) (string, error) {
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Virtual settings for Home Assistant climate entities. They are published and
+// set like any other setting, but map onto several device settings:
+// HVACMode combines Operation and OperationMode, ZoneNTargetTemperature is
+// the heat or cool target of zone N, whichever applies to the current mode.
+const (
+	hvacModeSetting   = "HVACMode"
+	zoneTargetSetting = "Zone%dTargetTemperature"
+)
+
+var climateZones = []int{1, 2}
+
+// Home Assistant hvac mode for Operation and OperationMode labels
+func hvacMode(operation, operationMode string) string {
+	switch {
+	case strings.Contains(operation, "Off"):
+		return "off"
+	case strings.Contains(operationMode, "Heat"):
+		return "heat"
+	case strings.Contains(operationMode, "Cool"):
+		return "cool"
+	case strings.Contains(operationMode, "Auto"):
+		return "auto"
+	}
+	// tank only - zones are idle
+	return "off"
+}
+
+// Heat or cool target setting of a zone for a hvac mode
+func zoneTargetName(zone int, mode string) string {
+	if mode == "cool" {
+		return fmt.Sprintf("Zone%dTargetTemperatureCool", zone)
+	}
+	return fmt.Sprintf("Zone%dTargetTemperatureHeat", zone)
+}
+
+// Derives virtual climate settings from device settings topics
+func (aq *aquarea) climateSettings(user aquareaEndUserJSON, settings map[string]string) map[string]string {
+	topic := func(name string) string {
+		return aq.topics.device(user.Gwid, topicSettings, name)
+	}
+	operation, ok := settings[topic("Operation")]
+	if !ok {
+		return nil
+	}
+	mode := hvacMode(operation, settings[topic("OperationMode")])
+
+	climate := map[string]string{topic(hvacModeSetting): mode}
+	for _, zone := range climateZones {
+		if target, ok := settings[topic(zoneTargetName(zone, mode))]; ok {
+			climate[topic(fmt.Sprintf(zoneTargetSetting, zone))] = target
+		}
+	}
+	return climate
+}
+
+// Zone target follows the current mode
+func (aq *aquarea) expandZoneTarget(cmd aquareaCommand, zone int) []aquareaCommand {
+	mode := hvacMode(aq.currentSetting(cmd.deviceID, "Operation"), aq.currentSetting(cmd.deviceID, "OperationMode"))
+	cmd.setting = zoneTargetName(zone, mode)
+	return []aquareaCommand{cmd}
+}
+
+func (aq *aquarea) expandHVACMode(cmd aquareaCommand) ([]aquareaCommand, error) {
+	operation := aq.currentSetting(cmd.deviceID, "Operation")
+	withTank := strings.Contains(aq.currentSetting(cmd.deviceID, "OperationMode"), "Tank")
+	if cmd.value == "off" {
+		// zones off, hot water keeps going; without tank nothing is left to run
+		if withTank && !strings.Contains(operation, "Off") {
+			return []aquareaCommand{{deviceID: cmd.deviceID, setting: "OperationMode", value: aq.operationModeVariant("", true)}}, nil
+		}
+		return []aquareaCommand{{deviceID: cmd.deviceID, setting: "Operation", value: aq.optionContaining("Operation", "Off")}}, nil
+	}
+
+	// keep DHW as it is - Heat+Tank stays with tank when switched to Cool
+	var operationMode string
+	for _, label := range aq.settingOptions("OperationMode") {
+		if hvacMode("On", label) != cmd.value {
+			continue
+		}
+		if operationMode == "" || strings.Contains(label, "Tank") == withTank {
+			operationMode = label
+		}
+	}
+	if operationMode == "" {
+		return nil, fmt.Errorf("%s is not a valid value for %s", cmd.value, hvacModeSetting)
+	}
+
+	// mode first, so that the unit does not start in the old one
+	commands := []aquareaCommand{{deviceID: cmd.deviceID, setting: "OperationMode", value: operationMode}}
+	if strings.Contains(operation, "Off") {
+		commands = append(commands, aquareaCommand{deviceID: cmd.deviceID, setting: "Operation", value: aq.optionContaining("Operation", "On")})
+	}
+	return commands, nil
+}
+
+// Labels of all values of a basic setting, in the order of their codes
+func (aq *aquarea) settingOptions(name string) []string {
+	description, ok := aq.translation[aq.reverseTranslation[name]]
+	if !ok {
+		return nil
+	}
+	codes := make([]string, 0, len(description.Values))
+	for code := range description.Values {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return hexLess(codes[i], codes[j]) })
+
+	labels := make([]string, 0, len(codes))
+	for _, code := range codes {
+		labels = append(labels, aq.dictionaryWebUI[description.Values[code]])
+	}
+	return labels
+}
+
+// First option of a basic setting with text in its label, e.g. On or Off
+func (aq *aquarea) optionContaining(name, text string) string {
+	for _, label := range aq.settingOptions(name) {
+		if strings.Contains(label, text) {
+			return label
+		}
+	}
+	return ""
+}
+
+// Label of the current value of a basic setting, from the settings cache
+// or from commands of the same message expanded before
+func (aq *aquarea) currentSetting(deviceID, name string) string {
+	if value, ok := aq.pendingSettings[name]; ok {
+		return value
+	}
+	functionName := aq.reverseTranslation[name]
+	description, ok := aq.translation[functionName]
+	if !ok {
+		return ""
+	}
+	selected := aq.aquareaSettings[deviceID].SettingDataInfo[functionName].SelectedValue
+	for code, message := range description.Values {
+		if sameHexValue(code, selected) {
+			return aq.dictionaryWebUI[message]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rondoval/aquarea2mqtt/mockcloud"
+)
+
+func TestExpandHVACModeOff(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+	for _, test := range []struct {
+		operationMode string // on the device
+		want          []aquareaCommand
+	}{
+		// hot water keeps going
+		{"0x0B", []aquareaCommand{{deviceID: cloud.gwid, setting: "OperationMode", value: "Tank"}}},
+		{"0x0C", []aquareaCommand{{deviceID: cloud.gwid, setting: "OperationMode", value: "Tank"}}},
+		// nothing else to run
+		{"0x01", []aquareaCommand{{deviceID: cloud.gwid, setting: "Operation", value: "Off"}}},
+	} {
+		cloud.UpdateDevice(cloud.gwid, func(d *mockcloud.Device) {
+			d.Settings["function-setting-user-select-005"] = test.operationMode
+		})
+		readSettings(t, aq, cloud.gwid)
+		commands, err := aq.expandHVACMode(aquareaCommand{deviceID: cloud.gwid, setting: hvacModeSetting, value: "off"})
+		if err != nil || !reflect.DeepEqual(commands, test.want) {
+			t.Errorf("OperationMode %s: got %v, %v; want %v", test.operationMode, commands, err, test.want)
+		}
+	}
+}
+
+// Reads device settings into the cache, as a poll does
+func readSettings(t *testing.T, aq *aquarea, gwid string) map[string]string {
+	t.Helper()
+	user := aq.usersMap[gwid]
+	shiesuahruefutohkun, err := aq.getEndUserShiesuahruefutohkun(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := aq.getDeviceSettings(user, shiesuahruefutohkun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
+
+func TestClimateZones(t *testing.T) {
+	for _, test := range []struct {
+		zoneOperation string
+		zones         []string
+	}{
+		{"0x01", []string{"Zone1"}},
+		{"0x02", []string{"Zone2"}},
+		{"0x03", []string{"Zone1", "Zone2"}},
+	} {
+		cloud := newTestCloud(t)
+		cloud.UpdateDevice(cloud.gwid, func(d *mockcloud.Device) {
+			d.Settings["function-setting-user-select-015"] = test.zoneOperation
+		})
+		aq := newLoggedInAquarea(t, cloud)
+		config := aq.encodeClimates(readSettings(t, aq, cloud.gwid), aq.usersMap[cloud.gwid])
+		for _, zone := range []string{"Zone1", "Zone2"} {
+			_, got := config[aq.topics.discovery("climate", cloud.gwid, zone)]
+			want := false
+			for _, z := range test.zones {
+				want = want || z == zone
+			}
+			if got != want {
+				t.Errorf("ZoneOperationSetting %s: %s climate %v, want %v", test.zoneOperation, zone, got, want)
+			}
+		}
+	}
+}
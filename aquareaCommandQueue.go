@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Set commands waiting to be sent, per device. A command for a setting already waiting replaces it,
+// and the commands of a device are sent together in one request once none came for the debounce
+// window, so a slider dragged in Home Assistant ends up as one request with its final value.
+// Adding never blocks, commands coming while another request runs are merged as well.
+type commandQueue struct {
+	debounce time.Duration
+	notify   chan struct{} // a device may be due
+	pipeline *pipeline     // for queue depth
+	topics   *topicLayout
+
+	lock    sync.Mutex
+	devices map[string]*queuedCommands
+}
+
+type queuedCommands struct {
+	commands   []aquareaCommand // one per setting, in order of arrival
+	superseded []aquareaCommand // replaced by a newer command for the same setting
+	due        time.Time
+}
+
+func newCommandQueue(config configType, dataPipeline *pipeline) *commandQueue {
+	return &commandQueue{
+		debounce: parseDurationDefault(config.CommandDebounce, time.Second),
+		notify:   make(chan struct{}, 1),
+		pipeline: dataPipeline,
+		topics:   newTopicLayout(config),
+		devices:  make(map[string]*queuedCommands),
+	}
+}
+
+func (q *commandQueue) signal() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+		// already notified
+	}
+}
+
+// Queues the commands of an MQTT message, all for one device
+func (q *commandQueue) add(commands []aquareaCommand) {
+	deviceID := commands[0].deviceID
+	q.lock.Lock()
+	device, ok := q.devices[deviceID]
+	if !ok {
+		device = &queuedCommands{}
+		q.devices[deviceID] = device
+	}
+	for _, cmd := range commands {
+		for i, queued := range device.commands {
+			if queued.setting == cmd.setting {
+				device.superseded = append(device.superseded, queued)
+				device.commands = append(device.commands[:i], device.commands[i+1:]...)
+				break
+			}
+		}
+		device.commands = append(device.commands, cmd)
+	}
+	device.due = time.Now().Add(q.debounce)
+	depth := len(device.commands)
+	q.lock.Unlock()
+
+	q.publishDepth(deviceID, depth)
+	time.AfterFunc(q.debounce, q.signal)
+}
+
+// Takes the commands of devices due for sending
+func (q *commandQueue) take(now time.Time) []queuedCommands {
+	q.lock.Lock()
+	var due []queuedCommands
+	for deviceID, device := range q.devices {
+		if !device.due.After(now) {
+			due = append(due, *device)
+			delete(q.devices, deviceID)
+		}
+	}
+	q.lock.Unlock()
+
+	for _, queued := range due {
+		q.publishDepth(queued.commands[0].deviceID, 0)
+	}
+	return due
+}
+
+func (q *commandQueue) publishDepth(deviceID string, depth int) {
+	q.pipeline.publish(map[string]string{
+		q.topics.device(deviceID, topicSettings, "queue"): strconv.Itoa(depth),
+	})
+}
+
+// Replaced commands of MQTT messages which have none left to send, to be answered as superseded
+func (qc queuedCommands) supersededOnly() []aquareaCommand {
+	sent := make(map[*mqttRequest]bool)
+	for _, cmd := range qc.commands {
+		sent[cmd.request] = true
+	}
+	var superseded []aquareaCommand
+	for _, cmd := range qc.superseded {
+		if !sent[cmd.request] {
+			superseded = append(superseded, cmd)
+		}
+	}
+	return superseded
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandQueueMerges(t *testing.T) {
+	data := newPipeline()
+	q := newCommandQueue(configType{CommandDebounce: "1h"}, data)
+	first := &mqttRequest{responseTopic: "first"}
+	second := &mqttRequest{responseTopic: "second"}
+
+	q.add([]aquareaCommand{{"B123", "TankTargetTemperature", "50", first}})
+	q.add([]aquareaCommand{{"B123", "QuietMode", "Level 1", nil}})
+	q.add([]aquareaCommand{{"B123", "TankTargetTemperature", "52", second}})
+	q.add([]aquareaCommand{{"B999", "Operation", "On", nil}})
+
+	queued := q.take(time.Now().Add(2 * time.Hour))
+	if len(queued) != 2 {
+		t.Fatalf("%d devices due, want 2", len(queued))
+	}
+	for _, device := range queued {
+		if device.commands[0].deviceID != "B123" {
+			continue
+		}
+		if len(device.commands) != 2 || device.commands[0].setting != "QuietMode" || device.commands[1].value != "52" {
+			t.Errorf("commands %v, want QuietMode then the last tank target", device.commands)
+		}
+		if superseded := device.supersededOnly(); len(superseded) != 1 || superseded[0].request != first {
+			t.Errorf("superseded %v, want the first tank target", superseded)
+		}
+	}
+}
+
+func TestCommandQueueDebounce(t *testing.T) {
+	q := newCommandQueue(configType{CommandDebounce: "1h"}, newPipeline())
+	start := time.Now()
+	q.add([]aquareaCommand{{"B123", "TankTargetTemperature", "50", nil}})
+	if queued := q.take(start.Add(30 * time.Minute)); len(queued) != 0 {
+		t.Fatal("sent within the debounce window")
+	}
+	q.add([]aquareaCommand{{"B123", "TankTargetTemperature", "51", nil}})
+	queued := q.take(time.Now().Add(61 * time.Minute))
+	if len(queued) != 1 || len(queued[0].commands) != 1 || queued[0].commands[0].value != "51" {
+		t.Fatalf("queued %v, want the last value once", queued)
+	}
+	if queued := q.take(time.Now().Add(2 * time.Hour)); len(queued) != 0 {
+		t.Error("sent twice")
+	}
+}
+
+func TestCommandQueueDepth(t *testing.T) {
+	data := newPipeline()
+	q := newCommandQueue(configType{CommandDebounce: "1h"}, data)
+	depth := q.topics.device("B123", topicSettings, "queue")
+
+	q.add([]aquareaCommand{{"B123", "TankTargetTemperature", "50", nil}, {"B123", "QuietMode", "Level 1", nil}})
+	q.add([]aquareaCommand{{"B123", "QuietMode", "Level 2", nil}})
+	if v := data.take().values[depth]; v != "2" {
+		t.Errorf("depth %q, want 2", v)
+	}
+	q.take(time.Now().Add(2 * time.Hour))
+	if v := data.take().values[depth]; v != "0" {
+		t.Errorf("depth %q after sending, want 0", v)
+	}
+}
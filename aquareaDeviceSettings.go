@@ -7,78 +7,332 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// Settings panel
-func (aq *aquarea) sendSetting(cmd aquareaCommand) error {
-	if cmd.value == "----" {
-		log.Println("Dummy value - not sending to Aquarea Service Cloud")
-		return nil
-	}
-	if len(aq.aquareaSettings.SettingsBackgroundData) == 0 {
-		log.Println("Background data not received yet")
-		// should not normally happen - we'll initialize this after log in, before main loop
-		return nil
-	}
-
-	functionName := aq.reverseTranslation[cmd.setting]
-	functionNamePOST := strings.ReplaceAll(functionName, "function-setting-user-select-", "userSelect")
-	functionInfo := aq.translation[functionName]
-
-	switch functionInfo.Kind {
-	case "basic":
-		//reverse translation from friendly name to xxxx-yyyy code and then to hex value
-		cmd.value = aq.reverseDictionaryWebUI[cmd.value]
-		cmd.value = functionInfo.reverseValues[cmd.value]
-
-	case "placeholder":
-		i, _ := strconv.ParseInt(cmd.value, 0, 16)
-		if !strings.Contains(cmd.setting, "HolidayMode") {
-			// may be not true for all values...
-			i += 128
-		}
-		cmd.value = fmt.Sprintf("0x%X", uint8(i))
-	}
+// Outcomes of a setting change, published on aquarea/<id>/settings/<name>/result
+const (
+	settingAccepted = "accepted" // Service Cloud took the request
+	settingApplied  = "applied"  // the device reports the new value
+	settingRejected = "rejected" // Service Cloud returned an error code
+	settingTimeout  = "timeout"  // accepted, but the device did not report the new value in time
+	settingFailed   = "failed"   // request could not be made
+	settingInvalid  = "invalid"  // not sent - unknown setting or value out of range
+
+	settingSuperseded = "superseded" // MQTT v5 response only - replaced by a newer command before being sent
+)
+
+// Settings of a device as last read from Service Cloud
+type aquareaSettingValues struct {
+	values map[string]string // topic to value
+	time   time.Time
+}
+
+// A device setting to change, validated and encoded for Service Cloud
+type aquareaSettingChange struct {
+	cmd          aquareaCommand
+	functionName string // function-setting-user-select-xxx
+	value        string // hex
+}
+
+// A request accepted by Service Cloud, waiting for the device to report the new values.
+// Checked on a timer and on every poll, so that commands and polling go on meanwhile.
+type settingConfirmation struct {
+	deviceID string
+	commands []aquareaCommand // as received, for the MQTT v5 response
+	waiting  []aquareaSettingChange
+	result   string // applied, unless a change was superseded or timed out
+	deadline time.Time
+}
+
+// Answer to an MQTT v5 setting command
+type settingResponseJSON struct {
+	Setting   string `json:"setting"`
+	Requested string `json:"requested"`
+	Result    string `json:"result,omitempty"`
+	Value     string `json:"value,omitempty"` // as the device reports it
+}
+
+// Answer to an MQTT v5 bulk command
+type bulkResponseJSON struct {
+	Result   string                `json:"result"`
+	Settings []settingResponseJSON `json:"settings,omitempty"`
+}
 
-	user := aq.usersMap[cmd.deviceID]
+// Settings panel. Changes of one device go in one request, Service Cloud applies them together.
+// Returns accepted if Service Cloud took the request; the device applies it later, see awaitConfirmation.
+func (aq *aquarea) sendSettings(changes []aquareaSettingChange) (string, error) {
+	deviceID := changes[0].cmd.deviceID
+	user := aq.usersMap[deviceID]
 	shiesuahruefutohkun, err := aq.getEndUserShiesuahruefutohkun(user)
 	if err != nil {
-		return err
+		return aq.publishSettingResults(changes, settingFailed), err
+	}
+
+	// background data must come from this very device and be current
+	deviceSettings, err := aq.fetchDeviceSettings(user, shiesuahruefutohkun)
+	if err != nil {
+		return aq.publishSettingResults(changes, settingFailed), err
+	}
+	if len(deviceSettings.SettingsBackgroundData) == 0 {
+		return aq.publishSettingResults(changes, settingFailed), fmt.Errorf("No background data received for %s", deviceID)
 	}
 
 	values := url.Values{
-		"var.deviceId":            {user.DeviceID},
-		"var.preOperation":        {aq.aquareaSettings.SettingsBackgroundData["0x80"].Value},
-		"var.preMode":             {aq.aquareaSettings.SettingsBackgroundData["0xE0"].Value},
-		"var.preTank":             {aq.aquareaSettings.SettingsBackgroundData["0xE1"].Value},
-		"var." + functionNamePOST: {cmd.value},
-		"shiesuahruefutohkun":     {shiesuahruefutohkun},
+		"var.deviceId":        {user.DeviceID},
+		"var.preOperation":    {deviceSettings.SettingsBackgroundData["0x80"].Value},
+		"var.preMode":         {deviceSettings.SettingsBackgroundData["0xE0"].Value},
+		"var.preTank":         {deviceSettings.SettingsBackgroundData["0xE1"].Value},
+		"shiesuahruefutohkun": {shiesuahruefutohkun},
+	}
+	for _, change := range changes {
+		functionNamePOST := strings.ReplaceAll(change.functionName, "function-setting-user-select-", "userSelect")
+		values.Set("var."+functionNamePOST, change.value)
+		log.Printf("Setting %s to %s on %s", change.cmd.setting, change.value, deviceID)
 	}
 
-	log.Printf("Setting %s to %s on %s", cmd.setting, cmd.value, cmd.deviceID)
+	b, err := aq.httpPost(aq.AquareaServiceCloudURL+"/installer/api/function/setting/user/set", values)
+	if err != nil {
+		return aq.publishSettingResults(changes, settingFailed), err
+	}
+	var response aquareaFunctionSettingSetJSON
+	err = json.Unmarshal(b, &response)
+	if err != nil {
+		return aq.publishSettingResults(changes, settingFailed), err
+	}
+	if response.ErrorCode != 0 {
+		result := aq.publishSettingResults(changes, fmt.Sprintf("%s: error code %d", settingRejected, response.ErrorCode))
+		return result, fmt.Errorf("Settings on %s rejected, error code: %d", deviceID, response.ErrorCode)
+	}
+	return aq.publishSettingResults(changes, settingAccepted), nil
+}
 
-	_, err = aq.httpPost(aq.AquareaServiceCloudURL+"/installer/api/function/setting/user/set", values)
-	//TODO parse output json, check error code
-	//TODO usec check api to confirm settings are applied before returning
-	return err
+// Waits for the changes of an accepted request to show up. A change still waiting
+// for the same device setting is superseded by it.
+func (aq *aquarea) awaitConfirmation(commands []aquareaCommand, changes []aquareaSettingChange) {
+	deviceID := commands[0].deviceID
+	for _, confirmation := range aq.confirmations {
+		if confirmation.deviceID != deviceID {
+			continue
+		}
+		var waiting []aquareaSettingChange
+		for _, change := range confirmation.waiting {
+			if changed(changes, change.functionName) {
+				confirmation.result = worseResult(confirmation.result, settingSuperseded)
+			} else {
+				waiting = append(waiting, change)
+			}
+		}
+		confirmation.waiting = waiting
+	}
+	aq.confirmations = append(aq.confirmations, &settingConfirmation{
+		deviceID: deviceID,
+		commands: commands,
+		waiting:  changes,
+		result:   settingApplied,
+		deadline: time.Now().Add(aq.confirmTimeout),
+	})
+	aq.finishConfirmations()
 }
 
-func (aq *aquarea) getDeviceSettings(user aquareaEndUserJSON, shiesuahruefutohkun string) (map[string]string, error) {
+func changed(changes []aquareaSettingChange, functionName string) bool {
+	for _, change := range changes {
+		if change.functionName == functionName {
+			return true
+		}
+	}
+	return false
+}
+
+// Timeout tells more than superseded, which tells more than applied
+func worseResult(a, b string) string {
+	rank := map[string]int{settingApplied: 0, settingSuperseded: 1, settingTimeout: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// Reads settings of devices with changes waiting, and times out the ones waiting too long
+func (aq *aquarea) checkConfirmations() {
+	devices := make(map[string]bool)
+	for _, confirmation := range aq.confirmations {
+		devices[confirmation.deviceID] = true
+	}
+	for deviceID := range devices {
+		user, ok := aq.usersMap[deviceID]
+		if !ok || !aq.session.loggedIn() || !deviceOnline(user) {
+			continue
+		}
+		shiesuahruefutohkun, err := aq.getEndUserShiesuahruefutohkun(user)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		settings, err := aq.getDeviceSettings(user, shiesuahruefutohkun)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		aq.pipeline.publish(settings)
+		aq.resolveConfirmations(deviceID)
+	}
+
+	now := time.Now()
+	for _, confirmation := range aq.confirmations {
+		if len(confirmation.waiting) > 0 && now.After(confirmation.deadline) {
+			log.Printf("%d settings on %s not confirmed within %v", len(confirmation.waiting), confirmation.deviceID, aq.confirmTimeout)
+			aq.publishSettingResults(confirmation.waiting, settingTimeout)
+			confirmation.result = settingTimeout
+			confirmation.waiting = nil
+		}
+	}
+	aq.finishConfirmations()
+}
+
+// Marks changes applied which the device reports, after its settings were read
+func (aq *aquarea) resolveConfirmations(deviceID string) {
+	for _, confirmation := range aq.confirmations {
+		if confirmation.deviceID != deviceID {
+			continue
+		}
+		var waiting []aquareaSettingChange
+		for _, change := range confirmation.waiting {
+			selected := aq.aquareaSettings[deviceID].SettingDataInfo[change.functionName].SelectedValue
+			if sameHexValue(selected, change.value) {
+				aq.publishSettingResult(change.cmd, settingApplied)
+				log.Printf("Setting %s on %s applied", change.cmd.setting, deviceID)
+			} else {
+				waiting = append(waiting, change)
+			}
+		}
+		confirmation.waiting = waiting
+	}
+	aq.finishConfirmations()
+}
+
+// Answers MQTT v5 messages of requests with nothing left waiting
+func (aq *aquarea) finishConfirmations() {
+	var left []*settingConfirmation
+	for _, confirmation := range aq.confirmations {
+		if len(confirmation.waiting) > 0 {
+			left = append(left, confirmation)
+		} else {
+			aq.respondToCommands(confirmation.commands, confirmation.result)
+		}
+	}
+	aq.confirmations = left
+}
+
+// Gives up on all waiting changes, on shutdown
+func (aq *aquarea) abandonConfirmations() {
+	for _, confirmation := range aq.confirmations {
+		aq.publishSettingResults(confirmation.waiting, settingTimeout)
+		confirmation.result = settingTimeout
+		confirmation.waiting = nil
+	}
+	aq.finishConfirmations()
+}
+
+func (aq *aquarea) publishSettingResult(cmd aquareaCommand, result string) string {
+	aq.pipeline.publish(map[string]string{
+		aq.topics.device(cmd.deviceID, topicSettings, cmd.setting, "result"): result,
+	})
+	return result
+}
+
+func (aq *aquarea) publishSettingResults(changes []aquareaSettingChange, result string) string {
+	for _, change := range changes {
+		aq.publishSettingResult(change.cmd, result)
+	}
+	return result
+}
+
+// Answers MQTT v5 messages with the outcome of their commands
+func (aq *aquarea) respondToCommands(commands []aquareaCommand, result string) {
+	var requests []*mqttRequest
+	byRequest := make(map[*mqttRequest][]aquareaCommand)
+	for _, cmd := range commands {
+		if cmd.request == nil || cmd.request.responseTopic == "" {
+			continue
+		}
+		if _, ok := byRequest[cmd.request]; !ok {
+			requests = append(requests, cmd.request)
+		}
+		byRequest[cmd.request] = append(byRequest[cmd.request], cmd)
+	}
+	for _, request := range requests {
+		aq.respondToRequest(request, byRequest[request], result)
+	}
+}
+
+// Answers an MQTT v5 message with the outcome and the values the device reports,
+// timestamped with the time they were read
+func (aq *aquarea) respondToRequest(request *mqttRequest, commands []aquareaCommand, result string) {
+	deviceID := commands[0].deviceID
+	current := aq.settingValues[deviceID]
+	var settings []settingResponseJSON
+	for _, cmd := range commands {
+		settings = append(settings, settingResponseJSON{
+			Setting:   cmd.setting,
+			Requested: cmd.value,
+			Value:     current.values[aq.topics.device(deviceID, topicSettings, cmd.setting)],
+		})
+	}
+	var payload []byte
+	if request.bulk {
+		payload, _ = json.Marshal(bulkResponseJSON{Result: result, Settings: settings})
+	} else {
+		settings[0].Result = result
+		payload, _ = json.Marshal(settings[0])
+	}
+	user := map[string]string{"device": deviceID, "result": result}
+	if !current.time.IsZero() {
+		user["timestamp"] = current.time.UTC().Format(time.RFC3339)
+	}
+	aq.pipeline.respond(mqttResponse{request: *request, payload: string(payload), user: user})
+}
+
+// Service Cloud is not consistent about leading zeros and case
+func sameHexValue(a, b string) bool {
+	x, errA := strconv.ParseInt(a, 0, 16)
+	y, errB := strconv.ParseInt(b, 0, 16)
+	return errA == nil && errB == nil && x == y
+}
+
+func hexLess(a, b string) bool {
+	x, _ := strconv.ParseInt(a, 0, 16)
+	y, _ := strconv.ParseInt(b, 0, 16)
+	return x < y
+}
+
+// Gets settings of a device from Service Cloud and caches them
+func (aq *aquarea) fetchDeviceSettings(user aquareaEndUserJSON, shiesuahruefutohkun string) (aquareaFunctionSettingGetJSON, error) {
+	var deviceSettings aquareaFunctionSettingGetJSON
 	b, err := aq.httpPost(aq.AquareaServiceCloudURL+"/installer/api/function/setting/get", url.Values{
 		"var.deviceId":        {user.DeviceID},
 		"shiesuahruefutohkun": {shiesuahruefutohkun},
 	})
 	if err != nil {
-		return nil, err
+		return deviceSettings, err
 	}
-	err = json.Unmarshal(b, &aq.aquareaSettings)
+	err = json.Unmarshal(b, &deviceSettings)
+	if err != nil {
+		return deviceSettings, err
+	}
+	aq.aquareaSettings[user.Gwid] = deviceSettings
+	return deviceSettings, nil
+}
+
+func (aq *aquarea) getDeviceSettings(user aquareaEndUserJSON, shiesuahruefutohkun string) (map[string]string, error) {
+	deviceSettings, err := aq.fetchDeviceSettings(user, shiesuahruefutohkun)
 	if err != nil {
 		return nil, err
 	}
 
 	settings := make(map[string]string)
 
-	for key, val := range aq.aquareaSettings.SettingDataInfo {
+	for key, val := range deviceSettings.SettingDataInfo {
 		if !strings.Contains(key, "user") {
 			// not an user setting - ignoring
 			continue
@@ -95,18 +349,9 @@ func (aq *aquarea) getDeviceSettings(user aquareaEndUserJSON, shiesuahruefutohku
 				case "basic":
 					value = aq.dictionaryWebUI[translation.Values[val.SelectedValue]]
 
-					// post possible values to a subtopic
-					var allOptions string
-					isFirst := true
-					for _, option := range translation.Values {
-						if !isFirst {
-							allOptions += "\n"
-						} else {
-							isFirst = false
-						}
-						allOptions += aq.dictionaryWebUI[option]
-					}
-					settings[fmt.Sprintf("aquarea/%s/settings/%s/options", user.Gwid, translation.Name)] = allOptions
+					// post possible values to a subtopic, in a stable order
+					allOptions := strings.Join(aq.settingOptions(translation.Name), "\n")
+					settings[aq.topics.device(user.Gwid, topicSettings, translation.Name, "options")] = allOptions
 				case "placeholder":
 					i, _ := strconv.ParseInt(val.SelectedValue, 0, 16)
 					if !strings.Contains(translation.Name, "HolidayMode") {
@@ -119,10 +364,18 @@ func (aq *aquarea) getDeviceSettings(user aquareaEndUserJSON, shiesuahruefutohku
 				// not used in user settings, handling not correct
 				value = val.Placeholder // + val.Params
 			}
-			settings[fmt.Sprintf("aquarea/%s/settings/%s", user.Gwid, translation.Name)] = value
+			settings[aq.topics.device(user.Gwid, topicSettings, translation.Name)] = value
 		} else {
 			log.Printf("No metadata in translation.json for: %s", key)
 		}
 	}
+
+	for k, v := range aq.climateSettings(user, settings) {
+		settings[k] = v
+	}
+	for k, v := range aq.waterHeaterSettings(user, settings) {
+		settings[k] = v
+	}
+	aq.settingValues[user.Gwid] = aquareaSettingValues{settings, time.Now()}
 	return settings, err
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +37,8 @@ func (aq *aquarea) getDeviceLogInformation(user aquareaEndUserJSON, shiesuahruef
 		return nil, err
 	}
 
+	errorHistory := aq.processErrorHistory(user, aquareaLogData.ErrorHistory)
+
 	var deviceLog map[int64][]string
 	err = json.Unmarshal([]byte(aquareaLogData.LogData), &deviceLog)
 	if err != nil {
@@ -43,7 +46,7 @@ func (aq *aquarea) getDeviceLogInformation(user aquareaEndUserJSON, shiesuahruef
 	}
 	if len(deviceLog) < 1 {
 		// no data in log
-		return nil, nil
+		return errorHistory, nil
 	}
 
 	// we're interested in the most recent snapshot only
@@ -56,7 +59,7 @@ func (aq *aquarea) getDeviceLogInformation(user aquareaEndUserJSON, shiesuahruef
 
 	stats := make(map[string]string)
 	for i, val := range deviceLog[lastKey] {
-		topic := fmt.Sprintf("aquarea/%s/log/", user.Gwid) + aq.logItems[i].Name
+		topic := aq.topics.device(user.Gwid, topicLog, aq.logItems[i].Name)
 
 		if aq.logItems[i].Unit != "" {
 			stats[topic+"/unit"] = aq.logItems[i].Unit // unit of the value, extracted from name
@@ -68,7 +71,68 @@ func (aq *aquarea) getDeviceLogInformation(user aquareaEndUserJSON, shiesuahruef
 
 		stats[topic] = val
 	}
-	stats[fmt.Sprintf("aquarea/%s/log/Timestamp", user.Gwid)] = strconv.FormatInt(lastKey, 10)
-	stats[fmt.Sprintf("aquarea/%s/log/CurrentError", user.Gwid)] = strconv.Itoa(aquareaLogData.ErrorCode)
+	stats[aq.topics.device(user.Gwid, topicLog, "Timestamp")] = strconv.FormatInt(lastKey, 10)
+	for k, v := range aq.integrateEnergy(user, deviceLog) {
+		stats[k] = v
+	}
+	for k, v := range errorHistory {
+		stats[k] = v
+	}
 	return stats, nil
 }
+
+// Energy integrated from a power log item, in kWh since the bridge started.
+// Home Assistant takes the drop on restart as a meter reset.
+type energyCounter struct {
+	kWh  float64
+	last int64 // time of the last log row added, ms since epoch
+}
+
+// Power units of log items, to kW
+var powerUnits = map[string]float64{"kW": 1, "W": 0.001}
+
+// Adds power log items up into energy counters, for the Home Assistant energy dashboard.
+// Each row is the average power since the row before.
+func (aq *aquarea) integrateEnergy(user aquareaEndUserJSON, deviceLog map[int64][]string) map[string]string {
+	times := make([]int64, 0, len(deviceLog))
+	for t := range deviceLog {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+	energy := make(map[string]string)
+	for i, item := range aq.logItems {
+		description := aq.logItemDescription(item.Name)
+		scale, isPower := powerUnits[item.Unit]
+		if description == nil || description.Energy == "" || !isPower {
+			continue
+		}
+		key := user.Gwid + "/" + item.Name
+		counter, ok := aq.energyCounters[key]
+		if !ok {
+			// counting starts now
+			counter = &energyCounter{last: times[len(times)-1]}
+			aq.energyCounters[key] = counter
+		}
+		for _, t := range times {
+			if t <= counter.last {
+				continue
+			}
+			if i < len(deviceLog[t]) {
+				if power, err := strconv.ParseFloat(deviceLog[t][i], 64); err == nil {
+					counter.kWh += power * scale * float64(t-counter.last) / float64(time.Hour/time.Millisecond)
+				}
+			}
+			counter.last = t
+		}
+		topic := aq.topics.device(user.Gwid, topicLog, description.Energy)
+		energy[topic] = strconv.FormatFloat(counter.kWh, 'f', 3, 64)
+		energy[topic+"/unit"] = "kWh"
+	}
+	return energy
+}
+
+// Home Assistant semantics of a log item from translation.json, keyed log-item-<name>
+func (aq *aquarea) logItemDescription(name string) *aquareaFunctionDescription {
+	return aq.translation["log-item-"+name]
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/url"
 )
 
@@ -25,7 +24,7 @@ func (aq aquarea) parseDeviceStatus(user aquareaEndUserJSON, shiesuahruefutohkun
 		case "simple-value":
 			value = val.Value
 		}
-		deviceStatus[fmt.Sprintf("aquarea/%s/state/%s", user.Gwid, name)] = value
+		deviceStatus[aq.topics.device(user.Gwid, topicState, name)] = value
 
 	}
 	return deviceStatus, err
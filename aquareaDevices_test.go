@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rondoval/aquarea2mqtt/mockcloud"
+)
+
+func TestDevicesAddedAndRemoved(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+
+	added := cloud.AddDevice()
+	cloud.RemoveDevice(cloud.gwid)
+	aq.feedDataFromAquarea()
+	if _, ok := aq.usersMap[added]; !ok {
+		t.Error("new device not picked up")
+	}
+	if _, ok := aq.usersMap[cloud.gwid]; ok {
+		t.Error("removed device still polled")
+	}
+	pending := aq.pipeline.take()
+	values, discovery := pending.values, pending.discovery
+	if values[aq.topics.device(cloud.gwid, topicStatus)] != "offline" {
+		t.Error("removed device not offline")
+	}
+	if values[aq.topics.device(added, topicSettings, "TankTargetTemperature")] == "" {
+		t.Error("new device not polled")
+	}
+	if discovery == nil || discovery.configs[aq.topics.discovery("binary_sensor", added, "Power")] == "" {
+		t.Fatal("no discovery for the new device")
+	}
+	for topic := range discovery.configs {
+		if strings.Contains(topic, "/"+cloud.gwid+"/") {
+			t.Errorf("discovery of removed device: %s", topic)
+		}
+	}
+}
+
+func TestDevicePower(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+
+	cloud.UpdateDevice(cloud.gwid, func(d *mockcloud.Device) { d.Power = "Off" })
+	aq.feedDataFromAquarea()
+	values := aq.pipeline.take().values
+	if v := values[aq.topics.device(cloud.gwid, topicStatus, "power")]; v != "Off" {
+		t.Errorf("power %q, want Off", v)
+	}
+}
+
+func TestDeviceListError(t *testing.T) {
+	aq := newTestAquarea(t, newLoginErrorCloud(t, `{"errorCode":5001,"endusers":[]}`))
+	if _, err := aq.getEndUsers(); err == nil {
+		t.Error("device list error code ignored")
+	}
+}
+
+func TestDeviceChangeFetchesOnce(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+
+	cloud.AddDevice()
+	settings := cloud.Requests("installer/api/function/setting/get")
+	status := cloud.Requests("installer/api/function/status")
+	aq.feedDataFromAquarea()
+	// both devices once, by the initial fetch
+	if n := cloud.Requests("installer/api/function/setting/get") - settings; n != 2 {
+		t.Errorf("%d settings reads, want 2", n)
+	}
+	if n := cloud.Requests("installer/api/function/status") - status; n != 2 {
+		t.Errorf("%d status reads, want 2", n)
+	}
+}
+
+func TestRemovedDeviceForgotten(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+	if aq.errorHistory[cloud.gwid] == nil || aq.energyCounters[cloud.gwid+"/HeatModeEnergyConsumption"] == nil {
+		t.Fatal("error history and energy counters not started by the login fetch")
+	}
+
+	cloud.RemoveDevice(cloud.gwid)
+	aq.feedDataFromAquarea()
+	if _, ok := aq.errorHistory[cloud.gwid]; ok {
+		t.Error("error history of removed device kept")
+	}
+	for key := range aq.energyCounters {
+		if strings.HasPrefix(key, cloud.gwid+"/") {
+			t.Errorf("energy counter %s of removed device kept", key)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+const errorCodesFile = "errorcodes.json"
+
+// Catalogue entry explaining an Aquarea error code (H76, F12...)
+type aquareaErrorCodeDescription struct {
+	Description string `json:"description"`
+	Severity    string `json:"severity"` // info, warning, error or critical
+	Action      string `json:"action"`
+}
+
+// Published on aquarea/<id>/events when a new error shows up in the error history,
+// as a list on aquarea/<id>/errors, the newest one on aquarea/<id>/errors/last
+// and the one the device reports now on aquarea/<id>/errors/current
+type aquareaErrorEvent struct {
+	Code        string `json:"code"`
+	Timestamp   string `json:"timestamp,omitempty"`
+	Description string `json:"description"`
+	Severity    string `json:"severity,omitempty"`
+	Action      string `json:"action,omitempty"`
+}
+
+// Loads the error code catalogue; entries from overrideFilename, if given, replace or extend shipped ones
+func (aq *aquarea) loadErrorCodes(filename, overrideFilename string) {
+	aq.errorCodes = make(map[string]aquareaErrorCodeDescription)
+	for _, f := range []string{filename, overrideFilename} {
+		if f == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = json.Unmarshal(data, &aq.errorCodes)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func (e aquareaErrorHistoryEntry) key() string {
+	return fmt.Sprintf("%s@%d", e.ErrorCode, e.ErrorDate)
+}
+
+// Emits each error history entry not seen before as an event and returns
+// the topic with the most recent errors
+func (aq *aquarea) processErrorHistory(user aquareaEndUserJSON, history []aquareaErrorHistoryEntry) map[string]string {
+	// newest first
+	sort.SliceStable(history, func(i, j int) bool { return history[i].ErrorDate > history[j].ErrorDate })
+
+	seen, known := aq.errorHistory[user.Gwid]
+	if !known {
+		// first fetch since start - these are old news, do not alert on them
+		seen = make(map[string]bool)
+		for _, e := range history {
+			seen[e.key()] = true
+		}
+		aq.errorHistory[user.Gwid] = seen
+	}
+
+	// oldest first, so that events arrive in order
+	for i := len(history) - 1; i >= 0; i-- {
+		e := history[i]
+		if seen[e.key()] {
+			continue
+		}
+		seen[e.key()] = true
+		data, err := json.Marshal(aq.errorEvent(e))
+		if err != nil {
+			continue
+		}
+		aq.pipeline.event(map[string]string{aq.topics.device(user.Gwid, topicEvents): string(data)})
+	}
+
+	recent := make([]aquareaErrorEvent, 0, aq.errorHistoryLength)
+	for i := 0; i < len(history) && i < aq.errorHistoryLength; i++ {
+		recent = append(recent, aq.errorEvent(history[i]))
+	}
+	data, _ := json.Marshal(recent)
+
+	// H00 is what the unit itself shows when there is nothing to report
+	last := aq.errorEvent(aquareaErrorHistoryEntry{ErrorCode: "H00"})
+	last.Timestamp = ""
+	if len(recent) > 0 {
+		last = recent[0]
+	}
+	lastData, _ := json.Marshal(last)
+
+	return map[string]string{
+		aq.topics.device(user.Gwid, topicErrors):         string(data),
+		aq.topics.device(user.Gwid, topicErrors, "last"): string(lastData),
+	}
+}
+
+// Error each device reports now in the device list, described from the catalogue
+func (aq *aquarea) currentErrors() map[string]string {
+	errors := make(map[string]string)
+	for _, user := range aq.usersMap {
+		current := aq.errorEvent(aquareaErrorHistoryEntry{ErrorCode: currentErrorCode(user)})
+		current.Timestamp = ""
+		data, _ := json.Marshal(current)
+		errors[aq.topics.device(user.Gwid, topicErrors, "current")] = string(data)
+	}
+	return errors
+}
+
+// H00 is what the unit itself shows when there is nothing to report
+func currentErrorCode(user aquareaEndUserJSON) string {
+	if code, ok := user.ErrorCode.(string); ok && code != "" {
+		return code
+	}
+	if user.ErrorName != "" {
+		return user.ErrorName
+	}
+	return "H00"
+}
+
+func (aq *aquarea) errorEvent(e aquareaErrorHistoryEntry) aquareaErrorEvent {
+	description := aq.describeErrorCode(e.ErrorCode)
+	return aquareaErrorEvent{
+		Code:        e.ErrorCode,
+		Timestamp:   time.Unix(0, e.ErrorDate*int64(time.Millisecond)).Format(time.RFC3339),
+		Description: description.Description,
+		Severity:    description.Severity,
+		Action:      description.Action,
+	}
+}
+
+// Looks the code up in the catalogue. Unknown codes get a generic description:
+// H codes report abnormalities (sensors, communication), F codes protective stops.
+func (aq *aquarea) describeErrorCode(code string) aquareaErrorCodeDescription {
+	if description, ok := aq.errorCodes[strings.ToUpper(code)]; ok {
+		return description
+	}
+	switch {
+	case strings.HasPrefix(code, "H"):
+		return aquareaErrorCodeDescription{Description: "Abnormality " + code, Severity: "error"}
+	case strings.HasPrefix(code, "F"):
+		return aquareaErrorCodeDescription{Description: "Protection stop " + code, Severity: "critical"}
+	}
+	return aquareaErrorCodeDescription{Description: "Error " + code}
+}
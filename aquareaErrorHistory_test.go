@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rondoval/aquarea2mqtt/mockcloud"
+)
+
+func TestCurrentError(t *testing.T) {
+	cloud := newTestCloud(t)
+	cloud.UpdateDevice(cloud.gwid, func(d *mockcloud.Device) { d.ErrorName = "H76" })
+	aq := newTestAquarea(t, cloud)
+	aq.login()
+
+	pending := aq.pipeline.take()
+	values, discovery := pending.values, pending.discovery
+	var current aquareaErrorEvent
+	if err := json.Unmarshal([]byte(values[aq.topics.device(cloud.gwid, topicErrors, "current")]), &current); err != nil {
+		t.Fatal(err)
+	}
+	if current.Code != "H76" || current.Severity != "warning" || current.Description == "" || current.Action == "" {
+		t.Errorf("current error %+v, want H76 described from the catalogue", current)
+	}
+
+	var sensor mqttSensor
+	if err := json.Unmarshal([]byte(discovery.configs[aq.topics.discovery("sensor", cloud.gwid, "CurrentError")]), &sensor); err != nil {
+		t.Fatal(err)
+	}
+	if sensor.StateTopic != aq.topics.device(cloud.gwid, topicErrors, "current") || sensor.JSONAttributesTopic != sensor.StateTopic {
+		t.Errorf("CurrentError sensor %+v, want state and attributes from errors/current", sensor)
+	}
+}
+
+func TestErrorHistoryEvents(t *testing.T) {
+	cloud := newTestCloud(t)
+	cloud.UpdateDevice(cloud.gwid, func(d *mockcloud.Device) {
+		d.ErrorHistory = []mockcloud.ErrorEntry{{Code: "H76", Date: 1000}}
+	})
+	aq := newLoggedInAquarea(t, cloud)
+	aq.feedDataFromAquarea()
+	if len(aq.pipeline.take().events) != 0 {
+		t.Fatal("old errors reported as events")
+	}
+
+	cloud.UpdateDevice(cloud.gwid, func(d *mockcloud.Device) {
+		d.ErrorHistory = append(d.ErrorHistory, mockcloud.ErrorEntry{Code: "F12", Date: 2000})
+	})
+	aq.feedDataFromAquarea()
+	aq.feedDataFromAquarea()
+	pending := aq.pipeline.take()
+	if n := len(pending.events); n != 1 {
+		t.Fatalf("%d events, want 1", n)
+	}
+	var event aquareaErrorEvent
+	json.Unmarshal([]byte(pending.events[0][aq.topics.device(cloud.gwid, topicEvents)]), &event)
+	if event.Code != "F12" || event.Severity != "critical" {
+		t.Errorf("event %+v, want F12", event)
+	}
+	values := pending.values
+	var last aquareaErrorEvent
+	json.Unmarshal([]byte(values[aq.topics.device(cloud.gwid, topicErrors, "last")]), &last)
+	if last.Code != "F12" {
+		t.Errorf("last error %s, want F12", last.Code)
+	}
+}
@@ -39,22 +39,24 @@ type aquareaStatusResponseJSON struct {
 }
 
 type aquareaLogDataJSON struct {
-	ErrorHistory []struct {
-		ErrorCode string `json:"errorCode"`
-		ErrorDate int64  `json:"errorDate"`
-	} `json:"errorHistory"`
-	LogData         string `json:"logData"`
-	ErrorCode       int    `json:"errorCode"`
-	RecordingStatus int    `json:"recordingStatus"`
-	HistoryNo       string `json:"historyNo"`
+	ErrorHistory    []aquareaErrorHistoryEntry `json:"errorHistory"`
+	LogData         string                     `json:"logData"`
+	ErrorCode       int                        `json:"errorCode"`
+	RecordingStatus int                        `json:"recordingStatus"`
+	HistoryNo       string                     `json:"historyNo"`
+}
+
+type aquareaErrorHistoryEntry struct {
+	ErrorCode string `json:"errorCode"`
+	ErrorDate int64  `json:"errorDate"` // milliseconds since epoch
 }
 
 type aquareaLoginJSON struct {
-	AgreementStatus struct {
+	AgreementStatus *struct {
 		Contract      bool `json:"contract"`
 		CookiePolicy  bool `json:"cookiePolicy"`
 		PrivacyPolicy bool `json:"privacyPolicy"`
-	} `json:"agreementStatus"`
+	} `json:"agreementStatus"` // only in some responses
 	ErrorCode int `json:"errorCode"`
 }
 
@@ -72,3 +74,8 @@ type aquareaFunctionSettingGetJSON struct {
 	} `json:"settingBackgroundData"`
 	ErrorCode int `json:"errorCode"`
 }
+
+// Response of function/setting/user/set
+type aquareaFunctionSettingSetJSON struct {
+	ErrorCode int `json:"errorCode"`
+}
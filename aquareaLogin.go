@@ -11,57 +11,83 @@ import (
 )
 
 // This gets tus through the entire login process, including populating string translation maps
-func (aq *aquarea) aquareaSetup() bool {
+func (aq *aquarea) aquareaSetup() error {
 	err := aq.aquareaLogin()
 	if err != nil {
-		log.Println(err)
-		return false
+		return err
 	}
 
 	err = aq.aquareaInstallerHome()
 	if err != nil {
-		log.Println(err)
-		return false
+		return err
 	}
 
 	aq.aquareaInitialFetch()
 
-	return true
+	return nil
 }
 
-// first fetch of data and Home Assistant discovery
-func (aq *aquarea) aquareaInitialFetch() {
+// first fetch of data and Home Assistant discovery. Tells which devices were read completely.
+func (aq *aquarea) aquareaInitialFetch() map[string]bool {
+	// discovery for all devices is sent at once, so that stale configs can be told apart
+	discovery := mqttDiscoverySet{configs: make(map[string]string), devices: make(map[string]bool)}
+	addConfig := func(config map[string]string) {
+		for k, v := range config {
+			discovery.configs[k] = v
+		}
+	}
+
+	aq.pipeline.publish(aq.deviceAvailability())
+	aq.pipeline.publish(aq.currentErrors())
+
 	// populate internal data by feeding sub pages
 	for _, user := range aq.usersMap {
+		discovery.devices[user.Gwid] = false
 		// Get settings from the device
 		shiesuahruefutohkun, err := aq.getEndUserShiesuahruefutohkun(user)
 		if err != nil {
 			continue
 		}
+		read := true
 
 		settings, err := aq.getDeviceSettings(user, shiesuahruefutohkun)
 		if err != nil {
 			log.Println(err)
+			read = false
 		} else {
-			// send HA configuration
-			haConfig := aq.encodeSwitches(settings, user)
-			aq.dataChannel <- haConfig
+			aq.pipeline.publish(settings)
+			aq.resolveConfirmations(user.Gwid)
+			// HA configuration
+			addConfig(aq.encodeSwitches(settings, user))
+			addConfig(aq.encodeButtons(settings, user))
+			addConfig(aq.encodeClimates(settings, user))
+			addConfig(aq.encodeWaterHeaters(settings, user))
 		}
 
-		_, err = aq.parseDeviceStatus(user, shiesuahruefutohkun)
+		status, err := aq.parseDeviceStatus(user, shiesuahruefutohkun)
 		if err != nil {
 			log.Println(err)
+			read = false
+		} else {
+			aq.pipeline.publish(status)
+			addConfig(aq.encodeStatusSensors(status, user))
 		}
-		// not using it for Home Assistant setup - at least for now
 
-		settings, err = aq.getDeviceLogInformation(user, shiesuahruefutohkun)
+		logData, err := aq.getDeviceLogInformation(user, shiesuahruefutohkun)
 		if err != nil {
 			log.Println(err)
+			read = false
 		} else {
-			haConfig := aq.encodeSensors(settings, user)
-			aq.dataChannel <- haConfig
+			aq.pipeline.publish(logData)
+			addConfig(aq.encodeSensors(logData, user))
 		}
+
+		addConfig(aq.encodeErrorSensors(user.Gwid))
+		addConfig(aq.encodePowerSensor(user.Gwid))
+		discovery.devices[user.Gwid] = read
 	}
+	aq.pipeline.publishDiscovery(discovery)
+	return discovery.devices
 }
 
 func (aq *aquarea) aquareaLogin() error {
@@ -70,10 +96,9 @@ func (aq *aquarea) aquareaLogin() error {
 		return err
 	}
 
-	data := []byte(aq.AquareaServiceCloudLogin + aq.AquareaServiceCloudPassword)
 	b, err := aq.httpPost(aq.AquareaServiceCloudURL+"installer/api/auth/login", url.Values{
 		"var.loginId":         {aq.AquareaServiceCloudLogin},
-		"var.password":        {fmt.Sprintf("%x", md5.Sum(data))},
+		"var.password":        {aquareaPasswordHash(aq.AquareaServiceCloudLogin, aq.AquareaServiceCloudPassword)},
 		"var.inputOmit":       {"false"},
 		"shiesuahruefutohkun": {shiesuahruefutohkun},
 	})
@@ -83,16 +108,29 @@ func (aq *aquarea) aquareaLogin() error {
 
 	var loginStruct aquareaLoginJSON
 	err = json.Unmarshal(b, &loginStruct)
+	if err != nil {
+		return err
+	}
 
 	if loginStruct.ErrorCode != 0 {
-		err = fmt.Errorf("Aquarea login error code: %d", loginStruct.ErrorCode)
+		agreed := loginStruct.AgreementStatus
+		agreement := agreed != nil && (!agreed.Contract || !agreed.CookiePolicy || !agreed.PrivacyPolicy)
+		return aquareaLoginError{loginStruct.ErrorCode, agreement}
 	}
-	return err
+	return nil
+}
+
+// Service Cloud expects MD5 of login and password concatenated
+func aquareaPasswordHash(login, password string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(login+password)))
 }
 
 func (aq *aquarea) aquareaInstallerHome() error {
 
 	body, err := aq.httpGet(aq.AquareaServiceCloudURL + "installer/home")
+	if err != nil {
+		return err
+	}
 	shiesuahruefutohkun, err := aq.extractShiesuahruefutohkun(body)
 	if err != nil {
 		return err
@@ -102,6 +140,24 @@ func (aq *aquarea) aquareaInstallerHome() error {
 		return err
 	}
 
+	aq.installerShiesuahruefutohkun = shiesuahruefutohkun
+	endUsers, err := aq.getEndUsers()
+	if err != nil {
+		return err
+	}
+
+	if len(endUsers) == 0 {
+		return fmt.Errorf("No devices linked to the account")
+	}
+
+	for _, user := range endUsers {
+		aq.usersMap[user.Gwid] = user
+	}
+	return aq.getDictionary(endUsers[0])
+}
+
+// Devices linked to the account, with their connection state
+func (aq *aquarea) getEndUsers() ([]aquareaEndUserJSON, error) {
 	b, err := aq.httpPost(aq.AquareaServiceCloudURL+"/installer/api/endusers", url.Values{
 		"var.name":            {""},
 		"var.deviceId":        {""},
@@ -114,27 +170,20 @@ func (aq *aquarea) aquareaInstallerHome() error {
 		"var.mapSizeX":        {"0"},
 		"var.mapSizeY":        {"0"},
 		"var.readNew":         {"1"},
-		"shiesuahruefutohkun": {shiesuahruefutohkun},
+		"shiesuahruefutohkun": {aq.installerShiesuahruefutohkun},
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	var endUsersList aquareaEndUsersListJSON
 	err = json.Unmarshal(b, &endUsersList)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	for _, user := range endUsersList.Endusers {
-		aq.usersMap[user.Gwid] = user
-	}
-	err = aq.getDictionary(endUsersList.Endusers[0])
-
-	if err == nil {
-		aq.statusChannel <- true
+	if endUsersList.ErrorCode != 0 {
+		return nil, fmt.Errorf("Device list request failed with error code %d", endUsersList.ErrorCode)
 	}
-
-	return err
+	return endUsersList.Endusers, nil
 }
 
 // Get lanugage translations from all sub pages
@@ -153,13 +202,6 @@ func (aq *aquarea) getDictionary(user aquareaEndUserJSON) error {
 		return err
 	}
 
-	// create reverse dictionary - required for changing settings
-	// reverse dictionary is needed for functionSertting page only
-	aq.reverseDictionaryWebUI = make(map[string]string)
-	for k, v := range aq.dictionaryWebUI {
-		aq.reverseDictionaryWebUI[v] = k
-	}
-
 	body, err = aq.httpPost(aq.AquareaServiceCloudURL+"installer/functionStatus", nil)
 	if err != nil {
 		return err
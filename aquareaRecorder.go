@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// One recorded request/response pair, stored as NNNNN.json in the fixture directory
+type aquareaFixture struct {
+	Method string     `json:"method"`
+	Path   string     `json:"path"`
+	Query  url.Values `json:"query,omitempty"`
+	Form   url.Values `json:"form,omitempty"`
+	Status int        `json:"status"`
+	Body   string     `json:"body"`
+}
+
+// Replay matches requests on method, path and device ID only - tokens and timestamps differ each run
+func (f aquareaFixture) key() string {
+	return f.Method + " " + f.Path + " " + f.Form.Get("var.deviceId")
+}
+
+func fixturePath(u *url.URL) string {
+	return strings.Trim(u.Path, "/")
+}
+
+// Records Aquarea traffic to a directory, with credentials and device identity redacted
+type recordingTransport struct {
+	next http.RoundTripper
+	dir  string
+
+	mu          sync.Mutex
+	sequence    int
+	credentials map[string]string // form value to placeholder, matched as a whole
+	secrets     map[string]string // value to placeholder, replaced anywhere regardless of case
+	identifiers map[string]int    // placeholder prefix to number of identifiers seen
+	devices     int
+}
+
+// Fields carrying device identity, with their placeholder prefix. Numbers are given in order
+// of appearance, so a recording maps each identifier to the same placeholder throughout.
+// A value in several fields gets the placeholder of the first field listed.
+var identifierFields = []struct{ field, prefix string }{
+	{"gwid", "gwid"},
+	{"deviceId", "device"},
+	{"gwUid", "gwuid"},
+	{"functionSelectedGwUid", "gwuid"},
+	{"enduserId", "enduser"},
+}
+
+// Shortest login also replaced inside bodies and paths
+const minLoginSecret = 4
+
+// Identifier fields in JSON, also escaped as in page scripts: "gwid":"..." or \"gwid\":\"...\"
+var identifierRegexp = regexp.MustCompile(`\\?"(gwid|deviceId|gwUid|functionSelectedGwUid|enduserId)\\?"\s*:\s*\\?"([^"\\]+)`)
+
+func newRecordingTransport(next http.RoundTripper, dir, login, password string) (*recordingTransport, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	rt := &recordingTransport{
+		next: next,
+		dir:  dir,
+		credentials: map[string]string{
+			login:                                "LOGIN",
+			password:                             "PASSWORD",
+			aquareaPasswordHash(login, password): "PASSWORD",
+		},
+		secrets:     make(map[string]string),
+		identifiers: make(map[string]int),
+	}
+	// pages and JSON may echo the login; a very short one would match everywhere
+	if len(login) >= minLoginSecret {
+		rt.addSecret(login, "LOGIN")
+	}
+	return rt, nil
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var form url.Values
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err == nil {
+			b, _ := ioutil.ReadAll(body)
+			form, _ = url.ParseQuery(string(b))
+		}
+	}
+
+	resp, err := rt.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// the client still gets the unredacted response
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	fixture := aquareaFixture{
+		Method: req.Method,
+		Status: resp.StatusCode,
+	}
+	// the request may carry identifiers not seen yet, learn them before anything is replaced
+	if len(form) > 0 {
+		fixture.Form = rt.redactForm(form)
+	}
+	if query := req.URL.Query(); len(query) > 0 {
+		fixture.Query = rt.redactForm(query)
+	}
+	fixture.Body = rt.redactBody(fixturePath(req.URL), b)
+	fixture.Path = rt.replaceSecrets(fixturePath(req.URL))
+	err = rt.write(fixture)
+	if err != nil {
+		log.Println(err)
+	}
+	return resp, nil
+}
+
+func (rt *recordingTransport) write(fixture aquareaFixture) error {
+	rt.sequence++
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false) // keep page markup readable
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(fixture)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(rt.dir, fmt.Sprintf("%05d.json", rt.sequence)), data.Bytes(), 0644)
+}
+
+// First placeholder wins, as the same value can show up in several fields
+func (rt *recordingTransport) addSecret(value, placeholder string) {
+	if _, ok := rt.secrets[strings.ToLower(value)]; !ok && value != "" {
+		rt.secrets[strings.ToLower(value)] = placeholder
+	}
+}
+
+// Gives an identifier the next placeholder of its kind, unless it has one already
+func (rt *recordingTransport) addIdentifier(prefix, value string) {
+	if _, known := rt.secrets[strings.ToLower(value)]; known || value == "" {
+		return
+	}
+	rt.identifiers[prefix]++
+	rt.addSecret(value, fmt.Sprintf("%s-%d", prefix, rt.identifiers[prefix]))
+}
+
+// Learns identifiers from fields, found by name
+func (rt *recordingTransport) addIdentifiers(fields map[string][]string) {
+	for _, id := range identifierFields {
+		for _, value := range fields[id.field] {
+			rt.addIdentifier(id.prefix, value)
+		}
+	}
+}
+
+func (rt *recordingTransport) redactForm(form url.Values) url.Values {
+	fields := make(map[string][]string)
+	for k, values := range form {
+		fields[strings.TrimPrefix(k, "var.")] = values
+	}
+	rt.addIdentifiers(fields)
+
+	redacted := make(url.Values)
+	for k, values := range form {
+		for _, v := range values {
+			if k == "shiesuahruefutohkun" {
+				v = "TOKEN"
+			} else if placeholder, ok := rt.credentials[v]; ok && v != "" {
+				v = placeholder
+			}
+			redacted.Add(k, rt.replaceSecrets(v))
+		}
+	}
+	return redacted
+}
+
+func (rt *recordingTransport) redactBody(path string, body []byte) string {
+	re := regexp.MustCompile(`const shiesuahruefutohkun = '(.+)'`)
+	for _, token := range re.FindAllStringSubmatch(string(body), -1) {
+		rt.addSecret(token[1], "TOKEN")
+	}
+	fields := make(map[string][]string)
+	for _, field := range identifierRegexp.FindAllStringSubmatch(string(body), -1) {
+		fields[field[1]] = append(fields[field[1]], field[2])
+	}
+	rt.addIdentifiers(fields)
+
+	if path == "installer/api/endusers" {
+		body = rt.redactEndUsers(body)
+	}
+	return rt.replaceSecrets(string(body))
+}
+
+// Strips personal data from the end user list
+func (rt *recordingTransport) redactEndUsers(body []byte) []byte {
+	var list map[string]interface{}
+	err := json.Unmarshal(body, &list)
+	if err != nil {
+		return body
+	}
+	users, _ := list["endusers"].([]interface{})
+	for _, u := range users {
+		user, ok := u.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rt.devices++
+		user["name"] = fmt.Sprintf("User %d", rt.devices)
+		user["address"] = ""
+		user["latitude"] = "0"
+		user["longitude"] = "0"
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+func (rt *recordingTransport) replaceSecrets(s string) string {
+	// longest first, so that a value containing another one is replaced as a whole
+	secrets := make([]string, 0, len(rt.secrets))
+	for k := range rt.secrets {
+		secrets = append(secrets, k)
+	}
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, secret := range secrets {
+		re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(secret))
+		s = re.ReplaceAllLiteralString(s, rt.secrets[secret])
+	}
+	return s
+}
+
+// Serves recorded fixtures instead of talking to Service Cloud
+type replayTransport struct {
+	mu       sync.Mutex
+	fixtures map[string][]aquareaFixture
+	served   map[string]int
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No fixtures found in %s", dir)
+	}
+	sort.Strings(files)
+
+	rt := &replayTransport{
+		fixtures: make(map[string][]aquareaFixture),
+		served:   make(map[string]int),
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var fixture aquareaFixture
+		err = json.Unmarshal(data, &fixture)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		rt.fixtures[fixture.key()] = append(rt.fixtures[fixture.key()], fixture)
+	}
+	return rt, nil
+}
+
+func (rt *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	request := aquareaFixture{Method: req.Method, Path: fixturePath(req.URL)}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err == nil {
+			b, _ := ioutil.ReadAll(body)
+			request.Form, _ = url.ParseQuery(string(b))
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	key := request.key()
+	recorded := rt.fixtures[key]
+	if len(recorded) == 0 {
+		log.Printf("Replay: no fixture for %s", key)
+		return replayResponse(req, http.StatusNotFound, ""), nil
+	}
+
+	// serve in recorded order, then keep repeating the last one
+	i := rt.served[key]
+	if i >= len(recorded) {
+		i = len(recorded) - 1
+	}
+	rt.served[key]++
+	return replayResponse(req, recorded[i].Status, recorded[i].Body), nil
+}
+
+func replayResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	cloud := newTestCloud(t)
+	dir := t.TempDir()
+	aq := newTestAquarea(t, cloud)
+	recorder, err := newRecordingTransport(http.DefaultTransport, dir, testLogin, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aq.httpClient.Transport = recorder
+	if err := aq.aquareaSetup(); err != nil {
+		t.Fatal(err)
+	}
+	aq.feedDataFromAquarea()
+	recorded := aq.pipeline.take().values
+
+	device, _ := cloud.Device(cloud.gwid)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(file)
+		fixture := strings.ToLower(string(data))
+		for _, secret := range []string{testLogin, testPassword, device.Gwid, device.DeviceID, device.GwUID} {
+			if strings.Contains(fixture, strings.ToLower(secret)) {
+				t.Errorf("%s contains %s", filepath.Base(file), secret)
+			}
+		}
+	}
+
+	replayer, err := newReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline := newTestAquarea(t, &testCloud{url: "http://replay.invalid/"})
+	offline.httpClient.Transport = replayer
+	if err := offline.aquareaSetup(); err != nil {
+		t.Fatal(err)
+	}
+	offline.feedDataFromAquarea()
+	replayed := offline.pipeline.take().values
+
+	if want := recorded[aq.topics.device(cloud.gwid, topicSettings, "TankTargetTemperature")]; want == "" {
+		t.Fatal("nothing recorded")
+	} else if got := replayed[aq.topics.device("gwid-1", topicSettings, "TankTargetTemperature")]; got != want {
+		t.Errorf("replayed tank target %q, want %q", got, want)
+	}
+}
+
+func TestRecorderRedactsIdentifiers(t *testing.T) {
+	recorder, err := newRecordingTransport(nil, t.TempDir(), testLogin, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// identifiers escaped in a page script, before the device list was seen
+	page := recorder.redactBody("installer/home", []byte(`const jsonMessage = eval('({\"gwid\":\"B2500000042\",\"deviceId\":\"008007ABCDEF\"})');`))
+	if strings.Contains(page, "B2500000042") || strings.Contains(page, "008007ABCDEF") {
+		t.Errorf("identifiers left in page: %s", page)
+	}
+	if !strings.Contains(page, "gwid-1") || !strings.Contains(page, "device-1") {
+		t.Errorf("placeholders missing in page: %s", page)
+	}
+
+	// the login echoed in a page
+	if page := recorder.redactBody("installer/home", []byte(`<span>`+strings.ToUpper(testLogin)+`</span>`)); page != "<span>LOGIN</span>" {
+		t.Errorf("login left in page: %s", page)
+	}
+
+	// same device later, in another case, in a response and in a form
+	body := recorder.redactBody("installer/api/function/status", []byte(`{"deviceId":"008007abcdef"}`))
+	if body != `{"deviceId":"device-1"}` {
+		t.Errorf("body %s, want the same placeholder", body)
+	}
+	form := recorder.redactForm(map[string][]string{"var.deviceId": {"008007ABCDEF"}, "var.gwid": {"B2500000043"}})
+	if form.Get("var.deviceId") != "device-1" || form.Get("var.gwid") != "gwid-2" {
+		t.Errorf("form %v, want device-1 and gwid-2", form)
+	}
+}
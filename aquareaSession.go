@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Service Cloud session states, published on aquarea/session
+type sessionState int
+
+const (
+	sessionLoggedOut sessionState = iota // not logged in, next attempt scheduled
+	sessionLoggingIn                     // login in progress
+	sessionReady                         // logged in, last poll fully successful
+	sessionDegraded                      // logged in, but some data could not be fetched
+	sessionLockedOut                     // login refused by Service Cloud, retrying rarely
+)
+
+func (s sessionState) String() string {
+	switch s {
+	case sessionLoggedOut:
+		return "logged-out"
+	case sessionLoggingIn:
+		return "logging-in"
+	case sessionReady:
+		return "ready"
+	case sessionDegraded:
+		return "degraded"
+	case sessionLockedOut:
+		return "locked-out"
+	}
+	return "unknown"
+}
+
+// Delays between login attempts. A login refused by Service Cloud backs off much further,
+// so that a wrong password does not get the account locked.
+const (
+	loginBackoffMin   = 5 * time.Second
+	loginBackoffMax   = 10 * time.Minute
+	lockoutBackoffMin = 15 * time.Minute
+	lockoutBackoffMax = 6 * time.Hour
+)
+
+// Login was refused by Service Cloud i.e. not a network problem
+type aquareaLoginError struct {
+	errorCode int
+	agreement bool // terms or policies not accepted for the account
+}
+
+func (e aquareaLoginError) Error() string {
+	if e.agreement {
+		return fmt.Sprintf("Aquarea login error code: %d, terms not accepted for the account - log in once in a browser", e.errorCode)
+	}
+	return fmt.Sprintf("Aquarea login error code: %d", e.errorCode)
+}
+
+type aquareaSession struct {
+	state    sessionState
+	attempts int // failed login attempts in a row
+	random   *rand.Rand
+}
+
+func newAquareaSession() aquareaSession {
+	return aquareaSession{
+		state:  sessionLoggedOut,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *aquareaSession) loggedIn() bool {
+	return s.state == sessionReady || s.state == sessionDegraded
+}
+
+// Exponential backoff with jitter - the delay is picked from the upper half of the window
+func (s *aquareaSession) backoff() time.Duration {
+	min, max := loginBackoffMin, loginBackoffMax
+	if s.state == sessionLockedOut {
+		min, max = lockoutBackoffMin, lockoutBackoffMax
+	}
+	delay := min
+	for i := 1; i < s.attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(s.random.Int63n(int64(delay/2)+1))
+}
+
+// Changes session state, publishing it and the online status on change
+func (aq *aquarea) setSessionState(state sessionState) {
+	if aq.session.state == state {
+		return
+	}
+	wasLoggedIn := aq.session.loggedIn()
+	log.Printf("Aquarea Service Cloud session: %s -> %s", aq.session.state, state)
+	aq.session.state = state
+	aq.pipeline.publish(map[string]string{aq.topics.bridge("session"): state.String()})
+
+	if aq.session.loggedIn() != wasLoggedIn {
+		aq.pipeline.setStatus(aq.session.loggedIn())
+	}
+}
+
+// Attempts to log in. Returns delay till next attempt, or zero if logged in.
+func (aq *aquarea) login() time.Duration {
+	aq.setSessionState(sessionLoggingIn)
+	err := aq.aquareaSetup()
+	if err == nil {
+		aq.session.attempts = 0
+		aq.setSessionState(sessionReady)
+		log.Println("Logged in to Aquarea Service Cloud")
+		return 0
+	}
+
+	log.Println(err)
+	aq.session.attempts++
+	if _, ok := err.(aquareaLoginError); ok {
+		// no error code of Service Cloud is known to be transient
+		aq.setSessionState(sessionLockedOut)
+	} else {
+		aq.setSessionState(sessionLoggedOut)
+	}
+	delay := aq.session.backoff()
+	log.Printf("Will attempt to log in again in %v", delay.Round(time.Second))
+	return delay
+}
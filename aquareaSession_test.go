@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Service Cloud answering every login with the given JSON
+func newLoginErrorCloud(t *testing.T, response string) *testCloud {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, "const shiesuahruefutohkun = 'token';")
+			return
+		}
+		fmt.Fprint(w, response)
+	}))
+	t.Cleanup(server.Close)
+	return &testCloud{url: server.URL + "/"}
+}
+
+func TestLoginLockout(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		cloud func(t *testing.T) *testCloud
+		state sessionState
+	}{
+		{"wrong password", func(t *testing.T) *testCloud {
+			cloud := newTestCloud(t)
+			cloud.Password = "changed"
+			return cloud
+		}, sessionLockedOut},
+		{"terms not accepted", func(t *testing.T) *testCloud {
+			return newLoginErrorCloud(t, `{"errorCode":4001,"agreementStatus":{"contract":false,"cookiePolicy":true,"privacyPolicy":true}}`)
+		}, sessionLockedOut},
+		{"unknown code", func(t *testing.T) *testCloud {
+			return newLoginErrorCloud(t, `{"errorCode":9999}`)
+		}, sessionLockedOut},
+		{"not JSON", func(t *testing.T) *testCloud {
+			return newLoginErrorCloud(t, `<html>maintenance</html>`)
+		}, sessionLoggedOut},
+	} {
+		aq := newTestAquarea(t, test.cloud(t))
+		delay := aq.login()
+		if aq.session.state != test.state {
+			t.Errorf("%s: session %s, want %s", test.name, aq.session.state, test.state)
+		}
+		if aq.session.loggedIn() {
+			t.Errorf("%s: logged in", test.name)
+		}
+		if locked := delay >= lockoutBackoffMin/2; locked != (test.state == sessionLockedOut) {
+			t.Errorf("%s: retry in %v", test.name, delay)
+		}
+	}
+}
+
+func TestDegradedPollStaysLoggedIn(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newTestAquarea(t, cloud)
+	if delay := aq.login(); delay != 0 {
+		t.Fatal("login failed")
+	}
+	aq.setSessionState(sessionDegraded)
+	if !aq.session.loggedIn() {
+		t.Error("degraded poll logged out")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Placeholder values are sent as a single byte
+const (
+	placeholderMin = -128
+	placeholderMax = 127
+)
+
+// Checks a set command against translation.json and encodes its value the way Service Cloud expects.
+// Returns function name (function-setting-user-select-xxx) and hex value.
+func (aq *aquarea) validateSetting(cmd aquareaCommand) (string, string, error) {
+	if _, ok := aq.usersMap[cmd.deviceID]; !ok {
+		return "", "", fmt.Errorf("unknown device %s", cmd.deviceID)
+	}
+	functionName, ok := aq.reverseTranslation[cmd.setting]
+	if !ok {
+		return "", "", fmt.Errorf("unknown setting %s", cmd.setting)
+	}
+	functionInfo := aq.translation[functionName]
+	value := strings.TrimSpace(cmd.value)
+	if value == "" {
+		return "", "", fmt.Errorf("empty value for %s", cmd.setting)
+	}
+
+	switch functionInfo.Kind {
+	case "basic":
+		// labels are not unique across settings (On, Off...), so look only at this setting's values
+		for hex, code := range functionInfo.Values {
+			if aq.dictionaryWebUI[code] == value {
+				return functionName, hex, nil
+			}
+		}
+		return "", "", fmt.Errorf("%s is not a valid value for %s", value, cmd.setting)
+
+	case "placeholder":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f != math.Trunc(f) {
+			return "", "", fmt.Errorf("%s is not a whole number", value)
+		}
+		i := int(f)
+		min, max := functionInfo.limits()
+		if i < min || i > max {
+			return "", "", fmt.Errorf("%d is out of range %d..%d for %s", i, min, max, cmd.setting)
+		}
+		if step := functionInfo.step(); (i-min)%step != 0 {
+			return "", "", fmt.Errorf("%d is not a multiple of step %d from %d for %s", i, step, min, cmd.setting)
+		}
+		if !strings.Contains(cmd.setting, "HolidayMode") {
+			// may be not true for all values...
+			i += 128
+		}
+		return functionName, fmt.Sprintf("0x%X", uint8(i)), nil
+	}
+	return "", "", fmt.Errorf("%s cannot be changed", cmd.setting)
+}
+
+// Range of a placeholder setting, from translation.json or whatever fits in a byte
+func (fd *aquareaFunctionDescription) limits() (int, int) {
+	min, max := placeholderMin, placeholderMax
+	if fd.Min != nil {
+		min = *fd.Min
+	}
+	if fd.Max != nil {
+		max = *fd.Max
+	}
+	return min, max
+}
+
+// Step of a placeholder setting, 1 unless translation.json says otherwise
+func (fd *aquareaFunctionDescription) step() int {
+	if fd.Step > 0 {
+		return fd.Step
+	}
+	return 1
+}
+
+// Range of a placeholder setting by its friendly name
+func (aq *aquarea) settingLimits(name string) (int, int) {
+	if description, ok := aq.translation[aq.reverseTranslation[name]]; ok {
+		return description.limits()
+	}
+	return placeholderMin, placeholderMax
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestValidateSetting(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+
+	for _, test := range []struct {
+		setting, value string
+		function, hex  string
+	}{
+		{"QuietMode", "Level 2", "function-setting-user-select-028", "0x03"},
+		{"Operation", "Off", "function-setting-user-select-003", "0x01"},
+		{"OperationMode", "Heat+Tank", "function-setting-user-select-005", "0x0B"},
+		{"TankTargetTemperature", "60", "function-setting-user-select-013", "0xBC"},
+		{"TankTargetTemperature", " 40 ", "function-setting-user-select-013", "0xA8"},
+		{"Zone1TargetTemperatureHeat", "-5", "function-setting-user-select-008", "0x7B"},
+		{"Zone1TargetTemperatureCool", "20.0", "function-setting-user-select-010", "0x94"},
+		// holiday shifts are plain two's complement, without the bias of 128
+		{"HolidayModeHeatShiftTemp", "-3", "function-setting-user-select-023", "0xFD"},
+		{"HolidayModeTankShiftTemp", "15", "function-setting-user-select-024", "0xF"},
+	} {
+		function, hex, err := aq.validateSetting(aquareaCommand{deviceID: cloud.gwid, setting: test.setting, value: test.value})
+		if err != nil {
+			t.Errorf("%s=%q: %v", test.setting, test.value, err)
+		} else if function != test.function || !sameHexValue(hex, test.hex) {
+			t.Errorf("%s=%q: got %s %s, want %s %s", test.setting, test.value, function, hex, test.function, test.hex)
+		}
+	}
+}
+
+func TestValidateSettingRejects(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+
+	for _, test := range []struct {
+		deviceID, setting, value string
+	}{
+		{"unknown", "Operation", "On"},
+		{cloud.gwid, "NoSuchSetting", "On"},
+		{cloud.gwid, "Operation", ""},
+		{cloud.gwid, "Operation", "Level 1"}, // a label of another setting
+		{cloud.gwid, "QuietMode", "level 1"},
+		{cloud.gwid, "TankTargetTemperature", "39"},
+		{cloud.gwid, "TankTargetTemperature", "76"},
+		{cloud.gwid, "TankTargetTemperature", "50.5"},
+		{cloud.gwid, "TankTargetTemperature", "hot"},
+		{cloud.gwid, "HolidayModeHeatShiftTemp", "-16"},
+	} {
+		if _, _, err := aq.validateSetting(aquareaCommand{deviceID: test.deviceID, setting: test.setting, value: test.value}); err == nil {
+			t.Errorf("%s %s=%q accepted", test.deviceID, test.setting, test.value)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Virtual setting for the Home Assistant water_heater entity. Maps DHW related
+// settings onto water heater operation modes:
+//
+//	off         - OperationMode without tank
+//	heat_pump   - tank heated normally
+//	high_demand - ForceDHW on
+//	performance - Powerful on
+//	electric    - Sterilization requested; never reported back, the unit does not tell
+const dhwModeSetting = "DHWMode"
+
+var dhwModes = []string{"off", "heat_pump", "high_demand", "performance", "electric"}
+
+// Water heater mode for current Operation, OperationMode, ForceDHW and Powerful labels
+func dhwMode(operation, operationMode, forceDHW, powerful string) string {
+	switch {
+	case strings.Contains(operation, "Off") || !strings.Contains(operationMode, "Tank"):
+		return "off"
+	case strings.Contains(forceDHW, "On"):
+		return "high_demand"
+	case powerful != "" && !strings.Contains(powerful, "Off"):
+		return "performance"
+	}
+	return "heat_pump"
+}
+
+// Derives the DHWMode virtual setting from device settings topics
+func (aq *aquarea) waterHeaterSettings(user aquareaEndUserJSON, settings map[string]string) map[string]string {
+	topic := func(name string) string {
+		return aq.topics.device(user.Gwid, topicSettings, name)
+	}
+	operation, ok := settings[topic("Operation")]
+	if !ok {
+		return nil
+	}
+	mode := dhwMode(operation, settings[topic("OperationMode")], settings[topic("ForceDHW")], settings[topic("Powerful")])
+	return map[string]string{topic(dhwModeSetting): mode}
+}
+
+func (aq *aquarea) expandDHWMode(cmd aquareaCommand) ([]aquareaCommand, error) {
+	operation := aq.currentSetting(cmd.deviceID, "Operation")
+	operationMode := aq.currentSetting(cmd.deviceID, "OperationMode")
+	forceDHW := aq.currentSetting(cmd.deviceID, "ForceDHW")
+	powerful := aq.currentSetting(cmd.deviceID, "Powerful")
+	command := func(setting, value string) aquareaCommand {
+		return aquareaCommand{deviceID: cmd.deviceID, setting: setting, value: value}
+	}
+
+	if cmd.value == "electric" {
+		return []aquareaCommand{command("Sterilization", aq.optionContaining("Sterilization", ""))}, nil
+	}
+
+	var commands []aquareaCommand
+	if cmd.value == "off" {
+		// same room mode, no tank; tank only means nothing left to run
+		if withoutTank := aq.operationModeVariant(operationMode, false); withoutTank != "" {
+			commands = append(commands, command("OperationMode", withoutTank))
+		} else {
+			commands = append(commands, command("Operation", aq.optionContaining("Operation", "Off")))
+		}
+		return commands, nil
+	}
+
+	found := false
+	for _, mode := range dhwModes {
+		found = found || mode == cmd.value
+	}
+	if !found {
+		return nil, fmt.Errorf("%s is not a valid value for %s", cmd.value, dhwModeSetting)
+	}
+
+	// tank must be on first; if the unit is off, run the tank only
+	if strings.Contains(operation, "Off") {
+		commands = append(commands, command("OperationMode", aq.operationModeVariant("", true)))
+		commands = append(commands, command("Operation", aq.optionContaining("Operation", "On")))
+	} else if !strings.Contains(operationMode, "Tank") {
+		commands = append(commands, command("OperationMode", aq.operationModeVariant(operationMode, true)))
+	}
+
+	forceOn := cmd.value == "high_demand"
+	if forceOn != strings.Contains(forceDHW, "On") {
+		if forceOn {
+			commands = append(commands, command("ForceDHW", aq.optionContaining("ForceDHW", "On")))
+		} else {
+			commands = append(commands, command("ForceDHW", aq.optionContaining("ForceDHW", "Off")))
+		}
+	}
+
+	powerfulOn := cmd.value == "performance"
+	if powerfulOn != (powerful != "" && !strings.Contains(powerful, "Off")) {
+		if powerfulOn {
+			// shortest powerful run
+			for _, label := range aq.settingOptions("Powerful") {
+				if !strings.Contains(label, "Off") {
+					commands = append(commands, command("Powerful", label))
+					break
+				}
+			}
+		} else {
+			commands = append(commands, command("Powerful", aq.optionContaining("Powerful", "Off")))
+		}
+	}
+	return commands, nil
+}
+
+// OperationMode option with the same room mode as current, with or without tank
+func (aq *aquarea) operationModeVariant(current string, withTank bool) string {
+	room := hvacMode("On", current)
+	for _, label := range aq.settingOptions("OperationMode") {
+		if hvacMode("On", label) == room && strings.Contains(label, "Tank") == withTank {
+			return label
+		}
+	}
+	return ""
+}
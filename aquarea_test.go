@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rondoval/aquarea2mqtt/mockcloud"
+)
+
+const (
+	testLogin    = "installer@example.com"
+	testPassword = "secret"
+)
+
+// Mock Service Cloud with one device, closed when the test ends
+type testCloud struct {
+	*mockcloud.Server
+	url  string
+	gwid string // of the device
+}
+
+func newTestCloud(t *testing.T) *testCloud {
+	t.Helper()
+	cloud := mockcloud.New(testLogin, testPassword)
+	gwid := cloud.AddDevice()
+	server := httptest.NewServer(cloud)
+	t.Cleanup(server.Close)
+	return &testCloud{cloud, server.URL + "/", gwid}
+}
+
+// Aquarea handler state talking to the mock, not logged in yet
+func newTestAquarea(t *testing.T, cloud *testCloud) *aquarea {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	aq := &aquarea{
+		AquareaServiceCloudURL:      cloud.url,
+		AquareaServiceCloudLogin:    testLogin,
+		AquareaServiceCloudPassword: testPassword,
+		confirmTimeout:              time.Second,
+		confirmInterval:             10 * time.Millisecond,
+		errorHistoryLength:          10,
+		pipeline:                    newPipeline(),
+		httpClient:                  http.Client{Jar: jar, Timeout: 5 * time.Second},
+		usersMap:                    make(map[string]aquareaEndUserJSON),
+		aquareaSettings:             make(map[string]aquareaFunctionSettingGetJSON),
+		settingValues:               make(map[string]aquareaSettingValues),
+		session:                     newAquareaSession(),
+		errorHistory:                make(map[string]map[string]bool),
+		energyCounters:              make(map[string]*energyCounter),
+		topics:                      newTopicLayout(configType{}),
+	}
+	aq.loadTranslations(translationFile)
+	aq.loadErrorCodes(errorCodesFile, "")
+	return aq
+}
+
+// Logged in handler state, with the pipeline emptied
+func newLoggedInAquarea(t *testing.T, cloud *testCloud) *aquarea {
+	t.Helper()
+	aq := newTestAquarea(t, cloud)
+	if err := aq.aquareaSetup(); err != nil {
+		t.Fatalf("aquareaSetup: %v", err)
+	}
+	aq.setSessionState(sessionReady)
+	aq.pipeline.take()
+	return aq
+}
+
+// The one MQTT v5 response taken from the pipeline
+func onlyResponse(t *testing.T, pending pipelineBatch) mqttResponse {
+	t.Helper()
+	if len(pending.responses) != 1 {
+		t.Fatalf("%d responses, want 1", len(pending.responses))
+	}
+	return pending.responses[0]
+}
+
+func TestLogin(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newTestAquarea(t, cloud)
+
+	if delay := aq.login(); delay != 0 {
+		t.Fatalf("login retry in %v, want logged in", delay)
+	}
+	if aq.session.state != sessionReady {
+		t.Errorf("session %s, want ready", aq.session.state)
+	}
+	if _, ok := aq.usersMap[gwid]; !ok {
+		t.Errorf("device %s not in users map", gwid)
+	}
+	if aq.dictionaryWebUI["2010-00DC"] != "On" {
+		t.Error("dictionary not extracted")
+	}
+	if len(aq.logItems) == 0 {
+		t.Error("log items not extracted")
+	}
+	pending := aq.pipeline.take()
+	values, status, discovery := pending.values, pending.status, pending.discovery
+	if status == nil || !*status {
+		t.Error("bridge status not set online")
+	}
+	if discovery == nil || !discovery.devices[gwid] {
+		t.Error("no complete discovery set")
+	}
+	if values["aquarea/session"] != "ready" {
+		t.Errorf("session topic %q, want ready", values["aquarea/session"])
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newTestAquarea(t, cloud)
+	aq.AquareaServiceCloudPassword = "wrong"
+
+	err := aq.aquareaLogin()
+	if _, ok := err.(aquareaLoginError); !ok {
+		t.Fatalf("got %v, want a login error", err)
+	}
+}
+
+func TestGetDeviceSettings(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	user := aq.usersMap[gwid]
+
+	shiesuahruefutohkun, err := aq.getEndUserShiesuahruefutohkun(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := aq.getDeviceSettings(user, shiesuahruefutohkun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"Operation":                "On",
+		"OperationMode":            "Heat+Tank",
+		"TankTargetTemperature":    "50",
+		"HolidayModeHeatShiftTemp": "-3",
+		"HVACMode":                 "heat",
+	} {
+		if got := settings[aq.topics.device(gwid, topicSettings, name)]; got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if aq.settingValues[gwid].time.IsZero() {
+		t.Error("setting values not stored for responses")
+	}
+}
+
+func TestSendSettings(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+
+	plan := aq.expandCommands([]aquareaCommand{
+		{deviceID: gwid, setting: "TankTargetTemperature", value: "60"},
+		{deviceID: gwid, setting: "QuietMode", value: "Level 2"},
+	})
+	if len(plan.invalid) != 0 {
+		t.Fatal(plan.invalid[0].err)
+	}
+	result, err := aq.sendSettings(plan.changes)
+	if err != nil || result != settingAccepted {
+		t.Fatalf("got %s, %v; want accepted", result, err)
+	}
+	if n := cloud.Requests("installer/api/function/setting/user/set"); n != 1 {
+		t.Errorf("%d set requests, want 1", n)
+	}
+	device, _ := cloud.Device(gwid)
+	if v := device.Settings["function-setting-user-select-013"]; v != "0xBC" {
+		t.Errorf("tank target on device %s, want 0xBC", v)
+	}
+	if v := device.Settings["function-setting-user-select-028"]; v != "0x03" {
+		t.Errorf("quiet mode on device %s, want 0x03", v)
+	}
+}
+
+func TestConfirmSettings(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	cloud.SetApplyDelay(time.Hour)
+	request := &mqttRequest{responseTopic: "reply"}
+
+	aq.executeCommands([]aquareaCommand{{gwid, "TankTargetTemperature", "60", request}})
+	resultTopic := aq.topics.device(gwid, topicSettings, "TankTargetTemperature", "result")
+	values := aq.pipeline.take().values
+	if values[resultTopic] != settingAccepted {
+		t.Fatalf("result %q, want accepted", values[resultTopic])
+	}
+	if len(aq.confirmations) != 1 {
+		t.Fatalf("%d confirmations waiting, want 1", len(aq.confirmations))
+	}
+
+	// not applied yet - keeps waiting, nothing answered
+	aq.checkConfirmations()
+	if len(aq.confirmations) != 1 || len(aq.pipeline.take().responses) != 0 {
+		t.Fatal("confirmed before the device applied the setting")
+	}
+
+	cloud.SetApplyDelay(0)
+	cloud.UpdateDevice(gwid, func(d *mockcloud.Device) { d.Settings["function-setting-user-select-013"] = "0xBC" })
+	aq.checkConfirmations()
+	pending := aq.pipeline.take()
+	values = pending.values
+	if values[resultTopic] != settingApplied {
+		t.Errorf("result %q, want applied", values[resultTopic])
+	}
+	if v := values[aq.topics.device(gwid, topicSettings, "TankTargetTemperature")]; v != "60" {
+		t.Errorf("new value %q not published", v)
+	}
+	if len(aq.confirmations) != 0 {
+		t.Error("confirmation still waiting")
+	}
+	response := onlyResponse(t, pending)
+	if response.user["result"] != settingApplied {
+		t.Errorf("response result %q, want applied", response.user["result"])
+	}
+}
+
+func TestConfirmSettingsTimeout(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	aq.confirmTimeout = 0
+	cloud.SetApplyDelay(time.Hour)
+
+	aq.executeCommands([]aquareaCommand{{gwid, "TankTargetTemperature", "60", &mqttRequest{responseTopic: "reply"}}})
+	aq.checkConfirmations()
+	pending := aq.pipeline.take()
+	if v := pending.values[aq.topics.device(gwid, topicSettings, "TankTargetTemperature", "result")]; v != settingTimeout {
+		t.Errorf("result %q, want timeout", v)
+	}
+	if response := onlyResponse(t, pending); response.user["result"] != settingTimeout {
+		t.Errorf("response result %q, want timeout", response.user["result"])
+	}
+}
+
+func TestConfirmationSuperseded(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	cloud.SetApplyDelay(time.Hour)
+
+	aq.executeCommands([]aquareaCommand{{gwid, "TankTargetTemperature", "60", &mqttRequest{responseTopic: "first"}}})
+	aq.executeCommands([]aquareaCommand{{gwid, "TankTargetTemperature", "61", &mqttRequest{responseTopic: "second"}}})
+	response := onlyResponse(t, aq.pipeline.take())
+	if response.request.responseTopic != "first" || response.user["result"] != settingSuperseded {
+		t.Errorf("got %s answered %s, want first superseded", response.request.responseTopic, response.user["result"])
+	}
+	if len(aq.confirmations) != 1 {
+		t.Errorf("%d confirmations waiting, want 1", len(aq.confirmations))
+	}
+}
+
+func TestConfirmationsAbandoned(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	cloud.SetApplyDelay(time.Hour)
+
+	aq.executeCommands([]aquareaCommand{{gwid, "TankTargetTemperature", "60", nil}})
+	aq.abandonConfirmations()
+	values := aq.pipeline.take().values
+	if v := values[aq.topics.device(gwid, topicSettings, "TankTargetTemperature", "result")]; v != settingTimeout {
+		t.Errorf("result %q, want timeout", v)
+	}
+	if len(aq.confirmations) != 0 {
+		t.Error("confirmation still waiting")
+	}
+}
+
+func TestBulkSettings(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	request := &mqttRequest{responseTopic: "reply", bulk: true}
+
+	commands, err := decodeBulkCommand(gwid, []byte(`{"TankTargetTemperature":60,"QuietMode":"Level 2"}`), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aq.executeCommands(commands)
+	if n := cloud.Requests("installer/api/function/setting/user/set"); n != 1 {
+		t.Errorf("%d set requests, want 1", n)
+	}
+	aq.checkConfirmations()
+	var answer bulkResponseJSON
+	if err := json.Unmarshal([]byte(onlyResponse(t, aq.pipeline.take()).payload), &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer.Result != settingApplied || len(answer.Settings) != 2 {
+		t.Errorf("answer %+v, want both settings applied", answer)
+	}
+}
+
+func TestInvalidCommandNotBlockingOthers(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	bulk := &mqttRequest{responseTopic: "bulk", bulk: true}
+
+	aq.executeCommands([]aquareaCommand{
+		{gwid, "TankTargetTemperature", "60", &mqttRequest{responseTopic: "tank"}},
+		{gwid, "QuietMode", "Level 9", &mqttRequest{responseTopic: "quiet"}},
+		// a bulk message is invalid as a whole
+		{gwid, "Zone1TargetTemperatureHeat", "2", bulk},
+		{gwid, "Operation", "Maybe", bulk},
+	})
+	if n := cloud.Requests("installer/api/function/setting/user/set"); n != 1 {
+		t.Fatalf("%d set requests, want 1", n)
+	}
+	device, _ := cloud.Device(gwid)
+	if v := device.Settings["function-setting-user-select-013"]; v != "0xBC" {
+		t.Errorf("tank target on device %s, want 0xBC", v)
+	}
+	if v := device.Settings["function-setting-user-select-008"]; v == "0x82" {
+		t.Error("part of an invalid bulk message sent")
+	}
+
+	pending := aq.pipeline.take()
+	for _, setting := range []string{"QuietMode", "Zone1TargetTemperatureHeat", "Operation"} {
+		if v := pending.values[aq.topics.device(gwid, topicSettings, setting, "result")]; !strings.HasPrefix(v, settingInvalid) {
+			t.Errorf("%s result %q, want invalid", setting, v)
+		}
+	}
+	answered := make(map[string]string)
+	for _, response := range pending.responses {
+		answered[response.request.responseTopic] = response.user["result"]
+	}
+	if !strings.HasPrefix(answered["quiet"], settingInvalid) || !strings.HasPrefix(answered["bulk"], settingInvalid) || answered["tank"] != "" {
+		t.Errorf("answered %v, want quiet and bulk invalid, tank waiting", answered)
+	}
+}
+
+func TestReplacedChangeSuperseded(t *testing.T) {
+	cloud := newTestCloud(t)
+	gwid := cloud.gwid
+	aq := newLoggedInAquarea(t, cloud)
+	cloud.SetApplyDelay(time.Hour)
+
+	// HVACMode sets OperationMode as well, replacing the change of the first message
+	aq.executeCommands([]aquareaCommand{
+		{gwid, "OperationMode", "Heat", &mqttRequest{responseTopic: "mode"}},
+		{gwid, "HVACMode", "cool", &mqttRequest{responseTopic: "hvac"}},
+	})
+	pending := aq.pipeline.take()
+	response := onlyResponse(t, pending)
+	if response.request.responseTopic != "mode" || response.user["result"] != settingSuperseded {
+		t.Errorf("got %s answered %s, want mode superseded", response.request.responseTopic, response.user["result"])
+	}
+	// the result topic tells about the newer change
+	if v := pending.values[aq.topics.device(gwid, topicSettings, "OperationMode", "result")]; v != settingAccepted {
+		t.Errorf("OperationMode result %q, want accepted", v)
+	}
+	if len(aq.confirmations) != 1 || len(aq.confirmations[0].commands) != 1 || aq.confirmations[0].commands[0].setting != "HVACMode" {
+		t.Errorf("waiting for %v, want HVACMode only", aq.confirmations)
+	}
+}
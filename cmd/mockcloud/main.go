@@ -0,0 +1,40 @@
+// Command mockcloud runs a fake Aquarea Service Cloud for offline development.
+//
+// Point AquareaServiceCloudURL at http://<listen address>/ and use the same
+// login and password as given here.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rondoval/aquarea2mqtt/mockcloud"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8080", "address to listen on")
+	login := flag.String("login", "installer", "installer account login")
+	password := flag.String("password", "secret", "installer account password")
+	devices := flag.Int("devices", 1, "number of heat pumps linked to the account")
+	applyDelay := flag.Duration("apply-delay", 0, "time before an accepted setting shows up")
+	flag.Parse()
+
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	server := mockcloud.New(*login, *password)
+	for i := 0; i < *devices; i++ {
+		log.Printf("Added device %s", server.AddDevice())
+	}
+	server.SetApplyDelay(*applyDelay)
+
+	log.Printf("Mock Service Cloud listening on http://%s/", *listen)
+	srv := &http.Server{
+		Addr:         *listen,
+		Handler:      server,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	log.Fatal(srv.ListenAndServe())
+}
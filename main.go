@@ -10,6 +10,7 @@ import (
 	"runtime"
 	"sync"
 	"syscall"
+	"time"
 )
 
 const configFileOther = "/data/options.json"
@@ -22,6 +23,19 @@ type configType struct {
 	AquareaTimeout              string
 	PoolInterval                string
 	LogSecOffset                int64
+	AquareaRecordDir            string
+	AquareaReplayDir            string
+	SettingConfirmTimeout       string
+	SettingConfirmInterval      string
+	ErrorHistoryLength          int
+	ErrorCodesFile              string
+	FullResyncInterval          string // publish all values again, not only changes; default 1h, 0 disables
+	CommandDebounce             string // wait for more commands before sending, default 1s
+
+	TopicPrefix     string            // default aquarea
+	DiscoveryPrefix string            // Home Assistant discovery prefix, default homeassistant
+	TopicSegments   map[string]string // category (settings, state, log, errors, events, status) to segment name
+	TopicTemplate   string            // device topics, default {prefix}/{device}/{category}/{name}
 
 	MqttServer    string
 	MqttPort      int
@@ -29,6 +43,15 @@ type configType struct {
 	MqttPass      string
 	MqttClientID  string
 	MqttKeepalive string
+	MqttVersion   int // 3 (default) or 5
+
+	MqttProtocol           string // tcp (default), ssl, ws or wss
+	MqttPath               string // WebSocket path
+	MqttCACert             string // PEM file with CA certificates to verify the broker with
+	MqttClientCert         string // PEM files with client certificate and key, for certificate authentication
+	MqttClientKey          string
+	MqttServerName         string // name in the broker certificate, if not MqttServer
+	MqttInsecureSkipVerify bool   // do not verify the broker certificate at all
 }
 
 func readConfig() configType {
@@ -52,26 +75,42 @@ func readConfig() configType {
 	return config
 }
 
+// for optional duration settings - empty means default
+func parseDurationDefault(value string, defaultValue time.Duration) time.Duration {
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	config := readConfig()
 
-	dataChannel := make(chan map[string]string, 10)
-	commandChannel := make(chan aquareaCommand, 10)
-	statusChannel := make(chan bool) // offline-online
+	dataPipeline := newPipeline()
+	commands := newCommandQueue(config, dataPipeline)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// the Aquarea handler stops first, so that its last results still reach MQTT
+	aquareaCtx, stopAquarea := context.WithCancel(context.Background())
+	mqttCtx, stopMQTT := context.WithCancel(context.Background())
+	var aquareaWG, mqttWG sync.WaitGroup
+	aquareaWG.Add(1)
+	mqttWG.Add(1)
 
-	go mqttHandler(ctx, &wg, config, dataChannel, commandChannel, statusChannel)
-	go aquareaHandler(ctx, &wg, config, dataChannel, commandChannel, statusChannel)
+	go mqttHandler(mqttCtx, &mqttWG, config, dataPipeline, commands)
+	go aquareaHandler(aquareaCtx, &aquareaWG, config, dataPipeline, commands)
 
-	termChan := make(chan os.Signal)
+	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 	<-termChan
 	log.Println("Shutting down")
-	cancel()
-	wg.Wait()
+	stopAquarea()
+	aquareaWG.Wait()
+	stopMQTT()
+	mqttWG.Wait()
 	log.Println("Shut down complete")
 }
@@ -0,0 +1,241 @@
+package mockcloud
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusValue is a single entry of the function/status response
+type StatusValue struct {
+	Type      string // basic-text (TextValue is a dictionary code) or simple-value
+	Value     string
+	TextValue string
+}
+
+// ErrorEntry is a single entry of the data/log error history
+type ErrorEntry struct {
+	Code string
+	Date int64 // milliseconds since epoch, like Service Cloud
+}
+
+// Device is a fake heat pump linked to the installer account
+type Device struct {
+	Name       string
+	Gwid       string
+	GwUID      string
+	DeviceID   string
+	Connection string
+	Power      string
+	ErrorName  string
+
+	Settings     map[string]string      // function-setting-user-select-XXX to selected hex value
+	Status       map[string]StatusValue // function-status-text-XXX
+	Log          []string               // current data/log row, in logItems order
+	ErrorHistory []ErrorEntry
+
+	pending []pendingSetting // accepted, but not yet applied changes
+}
+
+type pendingSetting struct {
+	key   string
+	value string
+	due   time.Time
+}
+
+func newDevice(n int) *Device {
+	d := &Device{
+		Name:       fmt.Sprintf("Mock heat pump %d", n),
+		Gwid:       fmt.Sprintf("B2500%06d", n),
+		GwUID:      fmt.Sprintf("00000000-0000-0000-0000-%012d", n),
+		DeviceID:   fmt.Sprintf("008007B%035d", n),
+		Connection: "Online",
+		Power:      "On",
+		Settings: map[string]string{
+			"function-setting-user-select-003": "0x02", // Operation: On
+			"function-setting-user-select-005": "0x0B", // OperationMode: Heat+Tank
+			"function-setting-user-select-008": encodeBiased(35),
+			"function-setting-user-select-009": encodeBiased(30),
+			"function-setting-user-select-010": encodeBiased(18),
+			"function-setting-user-select-011": encodeBiased(20),
+			"function-setting-user-select-013": encodeBiased(50),
+			"function-setting-user-select-015": "0x01",
+			"function-setting-user-select-018": "0x01",
+			"function-setting-user-select-020": "0x01",
+			"function-setting-user-select-022": "0x01",
+			"function-setting-user-select-023": encodeSigned(-3),
+			"function-setting-user-select-024": encodeSigned(-10),
+			"function-setting-user-select-026": "0x01",
+			"function-setting-user-select-028": "0x01",
+			"function-setting-user-select-030": "0x01",
+			"function-setting-user-select-032": "0x01",
+			"function-setting-user-select-034": "0x01",
+			"function-setting-user-select-035": "0x01",
+			"function-setting-user-select-036": "0x01",
+			"function-setting-user-select-038": "0x01",
+			"function-setting-user-select-040": "0x01",
+		},
+		Status: map[string]StatusValue{
+			"function-status-text-005": {Type: "basic-text"},
+			"function-status-text-007": {Type: "basic-text"},
+			"function-status-text-009": {Type: "simple-value", Value: "30"},
+			"function-status-text-011": {Type: "simple-value", Value: "35"},
+			"function-status-text-013": {Type: "simple-value", Value: "21"},
+			"function-status-text-015": {Type: "simple-value"},
+			"function-status-text-017": {Type: "simple-value", Value: "35"},
+			"function-status-text-019": {Type: "simple-value", Value: "20"},
+			"function-status-text-021": {Type: "simple-value"},
+			"function-status-text-023": {Type: "simple-value", Value: "30"},
+			"function-status-text-025": {Type: "simple-value", Value: "48"},
+			"function-status-text-027": {Type: "simple-value"},
+			"function-status-text-029": {Type: "simple-value", Value: "40"},
+			"function-status-text-031": {Type: "simple-value", Value: "5"},
+			"function-status-text-035": {Type: "simple-value", Value: "15.2"},
+			"function-status-text-037": {Type: "simple-value", Value: "3200"},
+			"function-status-text-039": {Type: "basic-text", TextValue: "2020-0007"},
+			"function-status-text-041": {Type: "basic-text", TextValue: "2020-0001"},
+			"function-status-text-043": {Type: "basic-text", TextValue: "2020-0001"},
+			"function-status-text-045": {Type: "basic-text", TextValue: "2020-0001"},
+			"function-status-text-047": {Type: "basic-text", TextValue: "2020-0001"},
+			"function-status-text-049": {Type: "simple-value", Value: "0"},
+			"function-status-text-051": {Type: "basic-text", TextValue: "2020-0008"},
+			"function-status-text-053": {Type: "basic-text", TextValue: "2020-000A"},
+			"function-status-text-056": {Type: "simple-value", Value: "45"},
+			"function-status-text-058": {Type: "simple-value", Value: "1234"},
+			"function-status-text-060": {Type: "simple-value", Value: "567"},
+			"function-status-text-063": {Type: "simple-value", Value: "3"},
+			"function-status-text-065": {Type: "simple-value", Value: "12"},
+			"function-status-text-068": {Type: "simple-value", Value: "3"},
+		},
+		Log: []string{"2", "1", "21", "", "20", "", "48", "", "5", "30", "35", "45", "3200", "15.2", "1", "1.2", "0", "4.1"},
+	}
+	d.sync()
+	return d
+}
+
+// applySetting stores a new selected value, either now or after the apply delay
+func (d *Device) applySetting(key, value string, delay time.Duration) {
+	if delay > 0 {
+		d.pending = append(d.pending, pendingSetting{key, value, time.Now().Add(delay)})
+		return
+	}
+	d.Settings[key] = value
+	d.sync()
+}
+
+// applyPending applies delayed changes which are due
+func (d *Device) applyPending() {
+	var left []pendingSetting
+	now := time.Now()
+	for _, p := range d.pending {
+		if now.Before(p.due) {
+			left = append(left, p)
+			continue
+		}
+		d.Settings[p.key] = p.value
+	}
+	d.pending = left
+	d.sync()
+}
+
+// sync derives status page and statistics values from current settings,
+// so that a change shows up everywhere like on a real unit
+func (d *Device) sync() {
+	operation := d.Settings["function-setting-user-select-003"]
+	mode := modeName(d.Settings["function-setting-user-select-005"])
+
+	if operation == "0x02" {
+		d.setStatusText("function-status-text-005", "2020-0002")
+		d.Log[0] = "2"
+	} else {
+		d.setStatusText("function-status-text-005", "2020-0001")
+		d.Log[0] = "1"
+	}
+
+	statusModes := map[string]string{"Heat": "2020-0003", "Cool": "2020-0004", "Auto": "2020-0005", "Tank": "2020-0006"}
+	logModes := map[string]string{"Heat": "1", "Cool": "2", "Auto": "3", "Tank": "4"}
+	d.setStatusText("function-status-text-007", statusModes[mode])
+	d.Log[1] = logModes[mode]
+
+	zone1 := decodeBiased(d.Settings["function-setting-user-select-008"])
+	zone2 := decodeBiased(d.Settings["function-setting-user-select-009"])
+	if mode == "Cool" {
+		zone1 = decodeBiased(d.Settings["function-setting-user-select-010"])
+		zone2 = decodeBiased(d.Settings["function-setting-user-select-011"])
+	}
+	tank := decodeBiased(d.Settings["function-setting-user-select-013"])
+	d.setStatusValue("function-status-text-015", zone1)
+	d.setStatusValue("function-status-text-021", zone2)
+	d.setStatusValue("function-status-text-027", tank)
+	d.Log[3] = strconv.Itoa(zone1)
+	d.Log[5] = strconv.Itoa(zone2)
+	d.Log[7] = strconv.Itoa(tank)
+}
+
+func (d *Device) setStatusText(key, code string) {
+	v := d.Status[key]
+	v.TextValue = code
+	d.Status[key] = v
+}
+
+func (d *Device) setStatusValue(key string, value int) {
+	v := d.Status[key]
+	v.Value = strconv.Itoa(value)
+	d.Status[key] = v
+}
+
+// background data the web UI posts back as var.preOperation/preMode/preTank
+func (d *Device) background() map[string]string {
+	return map[string]string{
+		"0x80": d.Settings["function-setting-user-select-003"],
+		"0xE0": d.Settings["function-setting-user-select-005"],
+		"0xE1": d.Settings["function-setting-user-select-013"],
+	}
+}
+
+func (d *Device) copy() Device {
+	c := *d
+	c.Settings = make(map[string]string)
+	for k, v := range d.Settings {
+		c.Settings[k] = v
+	}
+	c.Status = make(map[string]StatusValue)
+	for k, v := range d.Status {
+		c.Status[k] = v
+	}
+	c.Log = append([]string(nil), d.Log...)
+	c.ErrorHistory = append([]ErrorEntry(nil), d.ErrorHistory...)
+	c.pending = nil
+	return c
+}
+
+// first part of OperationMode i.e. Heat for Heat+Tank
+func modeName(value string) string {
+	option := settingOptions["function-setting-user-select-005"][value]
+	return strings.Split(dictionary[option], "+")[0]
+}
+
+// Most temperatures are sent as value + 128
+func encodeBiased(v int) string {
+	return fmt.Sprintf("0x%02X", uint8(v+128))
+}
+
+func decodeBiased(s string) int {
+	i, _ := strconv.ParseInt(s, 0, 16)
+	return int(int8(i - 128))
+}
+
+// Holiday mode shifts are plain two's complement
+func encodeSigned(v int) string {
+	return fmt.Sprintf("0x%02X", uint8(v))
+}
+
+// normalizeHex makes 0xa3, 0xA3 and 163 compare equal
+func normalizeHex(s string) (string, error) {
+	i, err := strconv.ParseInt(s, 0, 16)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("0x%02X", uint8(i)), nil
+}
@@ -0,0 +1,111 @@
+package mockcloud
+
+// Web UI dictionary served in jsonMessage on every page. The codes follow the
+// xxxx-yyyy scheme used by Service Cloud; the texts are what the English UI shows.
+var dictionary = map[string]string{
+	// settings page
+	"2010-00D7": "Off",
+	"2010-00DC": "On",
+	"2010-00E1": "Heat",
+	"2010-00E6": "Cool",
+	"2010-00EB": "Auto",
+	"2010-00F0": "Tank",
+	"2010-00F5": "Heat+Tank",
+	"2010-00FA": "Cool+Tank",
+	"2010-00FF": "Auto+Tank",
+	"2010-0122": "Zone1",
+	"2010-0127": "Zone2",
+	"2010-012C": "Zone1+2",
+	"2010-0136": "Off",
+	"2010-013B": "On",
+	"2010-0140": "Off",
+	"2010-0145": "On",
+	"2010-014A": "Off",
+	"2010-014F": "On",
+	"2010-0168": "Off",
+	"2010-016D": "On",
+	"2010-0172": "Off",
+	"2010-0177": "Level 1",
+	"2010-017C": "Level 2",
+	"2010-0181": "Level 3",
+	"2010-0186": "Off",
+	"2010-018B": "On",
+	"2010-0190": "Off",
+	"2010-0195": "On",
+	"2010-0197": "Top",
+	"2010-0198": "Center",
+	"2010-019A": "Request",
+	"2010-01A4": "Off",
+	"2010-01A9": "30min",
+	"2010-01AE": "60min",
+	"2010-01B3": "90min",
+	"2010-01B8": "Off",
+	"2010-01BD": "On",
+	"2010-01C2": "Request",
+
+	// status page
+	"2020-0001": "Off",
+	"2020-0002": "On",
+	"2020-0003": "Heat",
+	"2020-0004": "Cool",
+	"2020-0005": "Auto",
+	"2020-0006": "Tank",
+	"2020-0007": "Room",
+	"2020-0008": "Alternative",
+	"2020-0009": "Parallel",
+	"2020-000A": "No error",
+
+	// statistics page
+	"2030-0001": "Operation [1:Off,2:On]",
+	"2030-0002": "Mode [1:Heat,2:Cool,3:Auto,4:Tank]",
+	"2030-0003": "Zone1: (Actual) [°C]",
+	"2030-0004": "Zone1: (Target) [°C]",
+	"2030-0005": "Zone2: (Actual) [°C]",
+	"2030-0006": "Zone2: (Target) [°C]",
+	"2030-0007": "Tank: (Actual) [°C]",
+	"2030-0008": "Tank: (Target) [°C]",
+	"2030-0009": "Outdoor temperature [°C]",
+	"2030-000A": "Inlet water temperature [°C]",
+	"2030-000B": "Outlet water temperature [°C]",
+	"2030-000C": "Compressor frequency [Hz]",
+	"2030-000D": "Pump speed [r/min]",
+	"2030-000E": "Water flow [L/min]",
+	"2030-000F": "Defrost [1:Off,2:On]",
+	"2030-0010": "Heat mode energy consumption [kW]",
+	"2030-0011": "Tank mode energy consumption [kW]",
+	"2030-0012": "Heat mode energy generation [kW]",
+}
+
+// Order of items on the statistics page; data/log rows follow it.
+var logItems = []string{
+	"2030-0001", "2030-0002", "2030-0003", "2030-0004", "2030-0005", "2030-0006",
+	"2030-0007", "2030-0008", "2030-0009", "2030-000A", "2030-000B", "2030-000C",
+	"2030-000D", "2030-000E", "2030-000F", "2030-0010", "2030-0011", "2030-0012",
+}
+
+// Option codes per user setting, in the order Service Cloud lists them.
+// Settings without options are placeholders (numeric, 0x80 biased).
+var settingOptions = map[string]map[string]string{
+	"function-setting-user-select-003": {"0x01": "2010-00D7", "0x02": "2010-00DC"},
+	"function-setting-user-select-005": {"0x01": "2010-00E1", "0x02": "2010-00E6", "0x03": "2010-00EB", "0x08": "2010-00F0", "0x0B": "2010-00F5", "0x0C": "2010-00FA", "0x0D": "2010-00FF"},
+	"function-setting-user-select-008": nil,
+	"function-setting-user-select-009": nil,
+	"function-setting-user-select-010": nil,
+	"function-setting-user-select-011": nil,
+	"function-setting-user-select-013": nil,
+	"function-setting-user-select-015": {"0x01": "2010-0122", "0x02": "2010-0127", "0x03": "2010-012C"},
+	"function-setting-user-select-018": {"0x01": "2010-0136", "0x02": "2010-013B"},
+	"function-setting-user-select-020": {"0x01": "2010-0140", "0x02": "2010-0145"},
+	"function-setting-user-select-022": {"0x01": "2010-014A", "0x02": "2010-014F"},
+	"function-setting-user-select-023": nil,
+	"function-setting-user-select-024": nil,
+	"function-setting-user-select-026": {"0x01": "2010-0168", "0x02": "2010-016D"},
+	"function-setting-user-select-028": {"0x01": "2010-0172", "0x02": "2010-0177", "0x03": "2010-017C", "0x04": "2010-0181"},
+	"function-setting-user-select-030": {"0x01": "2010-0186", "0x02": "2010-018B"},
+	"function-setting-user-select-032": {"0x01": "2010-0190", "0x02": "2010-0195"},
+	"function-setting-user-select-034": {"0x01": "2010-019A"},
+	"function-setting-user-select-035": {"0x01": "2010-0197", "0x02": "2010-0198"},
+	"function-setting-user-select-036": {"0x01": "2010-01A4", "0x02": "2010-01A9", "0x03": "2010-01AE", "0x04": "2010-01B3"},
+	"function-setting-user-select-038": {"0x01": "2010-01B8", "0x02": "2010-01BD"},
+	"function-setting-user-select-040": {"0x01": "2010-01C2"},
+}
@@ -0,0 +1,373 @@
+// Package mockcloud is a stand-in for Panasonic Aquarea Service Cloud.
+//
+// It serves the pages and API endpoints aquarea2mqtt talks to and keeps a set
+// of stateful fake heat pumps, so a setting changed with function/setting/user/set
+// shows up in later function/setting/get, function/status and data/log reads.
+// Server implements http.Handler and is meant to be used with httptest.NewServer
+// or the cmd/mockcloud binary.
+package mockcloud
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error codes returned in errorCode. Values are specific to the mock.
+const (
+	ErrorCodeNone           = 0
+	ErrorCodeLoginFailed    = 1001
+	ErrorCodeSessionExpired = 1002
+	ErrorCodeInvalidToken   = 1003
+	ErrorCodeUnknownDevice  = 1004
+	ErrorCodeInvalidSetting = 1005
+	ErrorCodeDeviceOffline  = 1006
+)
+
+const sessionCookie = "JSESSIONID"
+
+// Server is a fake Service Cloud with an installer account and its devices
+type Server struct {
+	Login    string
+	Password string
+
+	mu            sync.Mutex
+	token         string            // shiesuahruefutohkun
+	sessions      map[string]string // session ID to selected gwUid
+	devices       []*Device
+	applyDelay    time.Duration
+	loginAttempts int
+	requests      map[string]int
+}
+
+// New creates a server with no devices; use AddDevice to add some
+func New(login, password string) *Server {
+	return &Server{
+		Login:    login,
+		Password: password,
+		token:    randomID(),
+		sessions: make(map[string]string),
+		requests: make(map[string]int),
+	}
+}
+
+// AddDevice adds a heat pump with default settings and returns its Gwid
+func (s *Server) AddDevice() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := newDevice(len(s.devices) + 1)
+	s.devices = append(s.devices, d)
+	return d.Gwid
+}
+
+// RemoveDevice unlinks a heat pump from the account
+func (s *Server) RemoveDevice(gwid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.devices {
+		if d.Gwid == gwid {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Device returns a snapshot of a device
+func (s *Server) Device(gwid string) (Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.Gwid == gwid {
+			d.applyPending()
+			return d.copy(), true
+		}
+	}
+	return Device{}, false
+}
+
+// UpdateDevice modifies a device in place, e.g. to add an error or take it offline
+func (s *Server) UpdateDevice(gwid string, update func(d *Device)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.Gwid == gwid {
+			update(d)
+			d.sync()
+			return true
+		}
+	}
+	return false
+}
+
+// SetApplyDelay makes accepted settings show up only after the given time,
+// like a real unit which needs a while to pick them up
+func (s *Server) SetApplyDelay(delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applyDelay = delay
+}
+
+// ExpireSessions logs everyone out
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]string)
+}
+
+// LoginAttempts returns the number of login requests, successful or not
+func (s *Server) LoginAttempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loginAttempts
+}
+
+// Requests returns the number of requests served for a path, e.g. "installer/api/function/setting/user/set"
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the bridge builds some URLs with a double slash
+	path := strings.Trim(r.URL.Path, "/")
+	r.ParseForm()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[path]++
+
+	switch path {
+	case "":
+		s.loginPage(w)
+	case "installer/api/auth/login":
+		s.login(w, r)
+	default:
+		session, ok := s.session(r)
+		if !ok {
+			if strings.HasPrefix(path, "installer/api/") {
+				writeJSON(w, map[string]int{"errorCode": ErrorCodeSessionExpired})
+			} else {
+				fmt.Fprint(w, "<html><body>Your session has timed out.</body></html>")
+			}
+			return
+		}
+		if strings.HasPrefix(path, "installer/api/") && r.PostForm.Get("shiesuahruefutohkun") != s.token {
+			writeJSON(w, map[string]int{"errorCode": ErrorCodeInvalidToken})
+			return
+		}
+		s.route(w, r, path, session)
+	}
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request, path, session string) {
+	switch path {
+	case "installer/home":
+		s.page(w, false)
+	case "installer/functionUserInformation":
+		s.sessions[session] = r.PostForm.Get("var.functionSelectedGwUid")
+		s.page(w, false)
+	case "installer/functionSetting", "installer/functionStatus":
+		s.page(w, false)
+	case "installer/functionStatistics":
+		s.page(w, true)
+	case "installer/api/endusers":
+		s.endUsers(w)
+	case "installer/api/function/setting/get":
+		s.withDevice(w, r, s.settingGet)
+	case "installer/api/function/setting/user/set":
+		s.withDevice(w, r, s.settingSet)
+	case "installer/api/function/status":
+		s.withDevice(w, r, s.status)
+	case "installer/api/data/log":
+		s.withDevice(w, r, s.log)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) loginPage(w http.ResponseWriter) {
+	fmt.Fprintf(w, "<html><head><script>\nconst shiesuahruefutohkun = '%s';\n</script></head><body>Aquarea Service Cloud</body></html>", s.token)
+}
+
+func (s *Server) page(w http.ResponseWriter, withLogItems bool) {
+	messages, _ := json.Marshal(dictionary)
+	fmt.Fprintf(w, "<html><head><script>\nconst shiesuahruefutohkun = '%s';\nconst jsonMessage = eval('(%s)');\n", s.token, messages)
+	if withLogItems {
+		items, _ := json.Marshal(logItems)
+		fmt.Fprintf(w, "var logItems = $.parseJSON('%s');\n", items)
+	}
+	fmt.Fprint(w, "</script></head><body></body></html>")
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	s.loginAttempts++
+	password := fmt.Sprintf("%x", md5.Sum([]byte(s.Login+s.Password)))
+	if r.PostForm.Get("shiesuahruefutohkun") != s.token {
+		writeJSON(w, map[string]int{"errorCode": ErrorCodeInvalidToken})
+		return
+	}
+	if r.PostForm.Get("var.loginId") != s.Login || r.PostForm.Get("var.password") != password {
+		writeJSON(w, map[string]int{"errorCode": ErrorCodeLoginFailed})
+		return
+	}
+
+	id := randomID()
+	s.sessions[id] = ""
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/"})
+	writeJSON(w, map[string]interface{}{
+		"agreementStatus": map[string]bool{"contract": true, "cookiePolicy": true, "privacyPolicy": true},
+		"errorCode":       ErrorCodeNone,
+	})
+}
+
+func (s *Server) session(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	_, ok := s.sessions[c.Value]
+	return c.Value, ok
+}
+
+func (s *Server) endUsers(w http.ResponseWriter) {
+	users := make([]map[string]interface{}, 0, len(s.devices))
+	for _, d := range s.devices {
+		users = append(users, map[string]interface{}{
+			"address":    "Mock street 1",
+			"companyId":  "mock",
+			"connection": d.Connection,
+			"deviceId":   d.DeviceID,
+			"enduserId":  d.Gwid,
+			"errorCode":  nil,
+			"errorName":  d.ErrorName,
+			"gwUid":      d.GwUID,
+			"gwid":       d.Gwid,
+			"idu":        "WH-SDC09H3E5",
+			"latitude":   "0",
+			"longitude":  "0",
+			"name":       d.Name,
+			"odu":        "WH-UD09HE5",
+			"power":      d.Power,
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"zoomMap":            0,
+		"errorCode":          ErrorCodeNone,
+		"endusers":           users,
+		"longitudeCenterMap": "0",
+		"size":               len(users),
+		"latitudeCenterMap":  "0",
+	})
+}
+
+func (s *Server) withDevice(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request, *Device)) {
+	for _, d := range s.devices {
+		if d.DeviceID == r.PostForm.Get("var.deviceId") {
+			d.applyPending()
+			handler(w, r, d)
+			return
+		}
+	}
+	writeJSON(w, map[string]int{"errorCode": ErrorCodeUnknownDevice})
+}
+
+func (s *Server) settingGet(w http.ResponseWriter, r *http.Request, d *Device) {
+	info := make(map[string]interface{})
+	for key, value := range d.Settings {
+		info[key] = map[string]interface{}{"type": "select", "selectedValue": value}
+	}
+	background := make(map[string]interface{})
+	for key, value := range d.background() {
+		background[key] = map[string]string{"value": value}
+	}
+	writeJSON(w, map[string]interface{}{
+		"settingDataInfo":       info,
+		"settingBackgroundData": background,
+		"errorCode":             ErrorCodeNone,
+	})
+}
+
+func (s *Server) settingSet(w http.ResponseWriter, r *http.Request, d *Device) {
+	if !strings.EqualFold(d.Connection, "Online") {
+		writeJSON(w, map[string]int{"errorCode": ErrorCodeDeviceOffline})
+		return
+	}
+
+	// validate everything first - the request is applied as a whole or not at all
+	changes := make(map[string]string)
+	for field, values := range r.PostForm {
+		if !strings.HasPrefix(field, "var.userSelect") {
+			continue
+		}
+		key := "function-setting-user-select-" + strings.TrimPrefix(field, "var.userSelect")
+		options, known := settingOptions[key]
+		value, err := normalizeHex(values[0])
+		if !known || err != nil {
+			writeJSON(w, map[string]int{"errorCode": ErrorCodeInvalidSetting})
+			return
+		}
+		if _, ok := options[value]; options != nil && !ok {
+			writeJSON(w, map[string]int{"errorCode": ErrorCodeInvalidSetting})
+			return
+		}
+		changes[key] = value
+	}
+	if len(changes) == 0 {
+		writeJSON(w, map[string]int{"errorCode": ErrorCodeInvalidSetting})
+		return
+	}
+
+	for key, value := range changes {
+		d.applySetting(key, value, s.applyDelay)
+	}
+	writeJSON(w, map[string]int{"errorCode": ErrorCodeNone})
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request, d *Device) {
+	info := make(map[string]interface{})
+	for key, value := range d.Status {
+		info[key] = map[string]string{"type": value.Type, "value": value.Value, "textValue": value.TextValue}
+	}
+	writeJSON(w, map[string]interface{}{
+		"errorCode":                ErrorCodeNone,
+		"statusDataInfo":           info,
+		"statusBackgroundDataInfo": map[string]interface{}{},
+	})
+}
+
+func (s *Server) log(w http.ResponseWriter, r *http.Request, d *Device) {
+	row, _ := json.Marshal(map[string][]string{
+		strconv.FormatInt(time.Now().Unix()*1000, 10): d.Log,
+	})
+	history := make([]map[string]interface{}, 0, len(d.ErrorHistory))
+	for _, e := range d.ErrorHistory {
+		history = append(history, map[string]interface{}{"errorCode": e.Code, "errorDate": e.Date})
+	}
+	writeJSON(w, map[string]interface{}{
+		"errorHistory":    history,
+		"logData":         string(row),
+		"errorCode":       ErrorCodeNone,
+		"recordingStatus": 0,
+		"historyNo":       strconv.Itoa(len(history)),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
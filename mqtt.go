@@ -1,103 +1,456 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
 	"sync"
 	"time"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// Response topic and correlation data of an MQTT v5 command, for answering it
+type mqttRequest struct {
+	responseTopic   string
+	correlationData []byte
+	bulk            bool // several settings in a JSON object
+}
+
+// Answer to an MQTT v5 command
+type mqttResponse struct {
+	request mqttRequest
+	payload string
+	user    map[string]string // user properties
+}
+
 type aquareaMQTT struct {
-	mqttClient     mqtt.Client
-	commandChannel chan aquareaCommand
+	mqttClient mqttClient
+	commands   *commandQueue
+	haOnline   chan bool // Home Assistant (re)started
+	connected  chan bool // connection to the broker (re)established
+	topics     *topicLayout
+	published  map[string]string    // retained values as last published, to send changes only
+	read       map[string]time.Time // when the published values were read from Service Cloud
+	online     bool                 // bridge status as last set
+
+	deliveryLock sync.Mutex
+	events       []map[string]string // not delivered yet, oldest first
+	responses    []mqttResponse      // not delivered yet, oldest first
+
+	discoveryLock     sync.Mutex
+	discovery         *mqttDiscoverySet // discovery configs currently published, nil before the first set
+	retainedDiscovery map[string]bool   // discovery topics of this bridge found retained on the broker
 }
 
-func mqttHandler(ctx context.Context, wg *sync.WaitGroup, config configType, dataChannel chan map[string]string, commandChannel chan aquareaCommand, statusChannel chan bool) {
+func mqttHandler(ctx context.Context, wg *sync.WaitGroup, config configType, data *pipeline, commands *commandQueue) {
 	defer wg.Done()
 	log.Println("Starting MQTT handler")
 	mqttKeepalive, err := time.ParseDuration(config.MqttKeepalive)
 	if err != nil {
 		log.Fatal(err)
 	}
+	var resync <-chan time.Time // never, if disabled
+	if resyncInterval := parseDurationDefault(config.FullResyncInterval, time.Hour); resyncInterval > 0 {
+		resyncTicker := time.NewTicker(resyncInterval)
+		defer resyncTicker.Stop()
+		resync = resyncTicker.C
+	}
 
 	var mqttInstance aquareaMQTT
-	mqttInstance.commandChannel = commandChannel
-	mqttInstance.makeMQTTConn(config.MqttServer, config.MqttPort, config.MqttLogin, config.MqttPass, config.MqttClientID, mqttKeepalive)
-	defer mqttInstance.mqttClient.Disconnect(2000)
+	mqttInstance.commands = commands
+	mqttInstance.haOnline = make(chan bool, 1)
+	mqttInstance.connected = make(chan bool, 1)
+	mqttInstance.published = make(map[string]string)
+	mqttInstance.read = make(map[string]time.Time)
+	mqttInstance.topics = newTopicLayout(config)
+	mqttInstance.retainedDiscovery = make(map[string]bool)
+	mqttInstance.makeMQTTConn(config, mqttKeepalive)
+	defer mqttInstance.mqttClient.disconnect()
 	defer mqttInstance.setStatus(false)
 
 	for {
 		select {
-		case dataToPublish := <-dataChannel:
-			mqttInstance.publish(dataToPublish)
-		case online := <-statusChannel:
-			mqttInstance.setStatus(online)
+		case <-data.notify:
+			mqttInstance.publishPending(data)
+		case <-mqttInstance.haOnline:
+			log.Println("Home Assistant online, publishing discovery")
+			mqttInstance.publish(mqttInstance.discoveryConfigs(), true)
+		case <-resync:
+			log.Println("Full resync of all topics")
+			mqttInstance.resync()
+		case <-mqttInstance.connected:
+			// the broker may have lost retained messages, e.g. on restart
+			log.Println("MQTT connected, resyncing all topics")
+			mqttInstance.resync()
+			mqttInstance.deliver()
 		case <-ctx.Done():
+			mqttInstance.flush(data)
 			return
 		}
 	}
 }
 
-func (am *aquareaMQTT) makeMQTTConn(mqttServer string, mqttPort int, mqttLogin, mqttPass, mqttClientID string, mqttKeepalive time.Duration) {
-	log.Println("Connecting to MQTT broker")
-	//set MQTT options
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("%s://%s:%v", "tcp", mqttServer, mqttPort))
-	opts.SetPassword(mqttPass)
-	opts.SetUsername(mqttLogin)
-	opts.SetClientID(mqttClientID)
-	opts.SetKeepAlive(mqttKeepalive)
-
-	opts.SetCleanSession(true)  // don't want to receive entire backlog of setting changes
-	opts.SetAutoReconnect(true) // default, but I want it explicit
-	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		c.Subscribe("aquarea/+/settings/+/set", 2, am.handleSubscription)
-	})
+func (am *aquareaMQTT) makeMQTTConn(config configType, mqttKeepalive time.Duration) {
+	brokerURL, err := mqttBrokerURL(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := mqttTLSConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	opts.SetWill("aquarea/status", "offline", byte(0), true)
+	version, err := mqttProtocolVersion(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// connect to broker
-	am.mqttClient = mqtt.NewClient(opts)
+	options := mqttConnOptions{
+		brokerURL: brokerURL,
+		tlsConfig: tlsConfig,
+		login:     config.MqttLogin,
+		password:  config.MqttPass,
+		clientID:  config.MqttClientID,
+		keepalive: mqttKeepalive,
+		willTopic: am.topics.bridge("status"),
+		onConnect: func() {
+			select {
+			case am.connected <- true:
+			default:
+				// resync already pending
+			}
+		},
+		subscriptions: []mqttSubscription{
+			{am.topics.device("+", topicSettings, "+", "set"), 2, am.handleSubscription},
+			{am.topics.device("+", topicSettings, "set"), 2, am.handleSubscription},
+			{am.topics.discoveryPrefix + "/status", 1, am.handleHAStatus},
+			{am.topics.discovery("+", "+", "+"), 0, am.handleRetainedDiscovery},
+		},
+	}
 
-	token := am.mqttClient.Connect()
-	if token.Wait() && token.Error() != nil {
-		log.Fatalf("Fail to connect broker, %v", token.Error())
+	// connects in the background, status, discovery and data are published once connected
+	log.Printf("Connecting to MQTT broker %s (MQTT v%d)", brokerURL, version)
+	if version == 5 {
+		am.mqttClient, err = newMQTTClientV5(options)
+	} else {
+		am.mqttClient = newMQTTClientV3(options)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-	log.Println("MQTT connected")
 
 	am.setStatus(false) // offline till Service Cloud is connected
 }
 
 func (am *aquareaMQTT) setStatus(online bool) {
+	am.online = online
 	var status string
 	if online {
 		status = "online"
 	} else {
 		status = "offline"
 	}
-	am.mqttClient.Publish("aquarea/status", byte(0), true, status)
+	if am.mqttClient.connected() {
+		am.mqttClient.publish(am.topics.bridge("status"), true, status, nil)
+	}
 }
 
-func (am *aquareaMQTT) handleSubscription(mclient mqtt.Client, msg mqtt.Message) {
-	topicPieces := strings.Split(msg.Topic(), "/")
-	if len(topicPieces) > 3 {
-		deviceID := topicPieces[1]
-		setting := topicPieces[3]
+func (am *aquareaMQTT) handleSubscription(msg mqttMessage) {
+	deviceID, category, name, ok := am.topics.parse(msg.topic)
+	if !ok || category != topicSettings {
+		return
+	}
+	var request *mqttRequest
+	if msg.responseTopic != "" || name == "set" {
+		// a bulk message always has one, its settings are validated together
+		request = &mqttRequest{msg.responseTopic, msg.correlationData, name == "set"}
+	}
+
+	if name == "set" {
+		log.Printf("Received: Device ID %s bulk settings", deviceID)
+		commands, err := decodeBulkCommand(deviceID, msg.payload, request)
+		if err != nil {
+			log.Println(err)
+			if request.responseTopic != "" {
+				result := fmt.Sprintf("%s: %v", settingInvalid, err)
+				payload, _ := json.Marshal(bulkResponseJSON{Result: result})
+				am.deliveryLock.Lock()
+				am.responses = append(am.responses, mqttResponse{request: *request, payload: string(payload), user: map[string]string{"device": deviceID, "result": result}})
+				am.deliveryLock.Unlock()
+				am.deliver()
+			}
+			return
+		}
+		am.commands.add(commands)
+	} else if strings.HasSuffix(name, "/set") {
+		setting := strings.TrimSuffix(name, "/set")
 
 		log.Printf("Received: Device ID %s setting: %s", deviceID, setting)
-		am.commandChannel <- aquareaCommand{deviceID, setting, string(msg.Payload())}
+		am.commands.add([]aquareaCommand{{deviceID, setting, string(msg.payload), request}})
+	}
+}
+
+// Decodes a bulk command, a JSON object of settings to values, keeping the order of the settings
+func decodeBulkCommand(deviceID string, payload []byte, request *mqttRequest) ([]aquareaCommand, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("bulk command must be a JSON object")
+	}
+	var commands []aquareaCommand
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		setting := token.(string)
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case string:
+			commands = append(commands, aquareaCommand{deviceID, setting, v, request})
+		case json.Number:
+			commands = append(commands, aquareaCommand{deviceID, setting, v.String(), request})
+		default:
+			return nil, fmt.Errorf("value of %s must be a string or a number", setting)
+		}
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("bulk command has no settings")
+	}
+	return commands, nil
+}
+
+// Sends data as it is. Nothing is sent while disconnected; retained data is restored by resync.
+func (am *aquareaMQTT) publish(data map[string]string, retained bool) {
+	if !am.mqttClient.connected() {
+		return
+	}
+	for key, value := range data {
+		err := am.mqttClient.publish(key, retained, value, nil)
+		if err != nil {
+			log.Printf("Fail to publish, %v", err)
+		}
+	}
+}
+
+// Publishes what the Aquarea handler left in the pipeline since last time
+func (am *aquareaMQTT) publishPending(data *pipeline) {
+	batch := data.take()
+	if batch.status != nil {
+		am.setStatus(*batch.status)
+	}
+	if batch.discovery != nil {
+		am.publishDiscovery(*batch.discovery)
+	}
+	dropped, _ := json.Marshal(batch.drops)
+	batch.values[am.topics.bridge("dropped")] = string(dropped)
+	am.publishChanges(batch.values, batch.read)
+
+	am.deliveryLock.Lock()
+	am.events = append(am.events, batch.events...)
+	am.responses = append(am.responses, batch.responses...)
+	am.deliveryLock.Unlock()
+	am.deliver()
+}
+
+// Publishes whatever is left in the pipeline, on shutdown
+func (am *aquareaMQTT) flush(data *pipeline) {
+	am.publishPending(data)
+	am.deliveryLock.Lock()
+	defer am.deliveryLock.Unlock()
+	if len(am.events) > 0 || len(am.responses) > 0 {
+		log.Printf("Shutting down with %d events and %d responses not delivered", len(am.events), len(am.responses))
 	}
 }
 
-func (am *aquareaMQTT) publish(data map[string]string) {
+// Publishes events and responses in order, as long as the broker takes them.
+// What is left is tried again with the next data and after reconnecting.
+func (am *aquareaMQTT) deliver() {
+	am.deliveryLock.Lock()
+	defer am.deliveryLock.Unlock()
+	for len(am.events) > 0 && am.mqttClient.connected() {
+		if !am.publishEvent(am.events[0]) {
+			break
+		}
+		am.events = am.events[1:]
+	}
+	for len(am.responses) > 0 && am.mqttClient.connected() {
+		if !am.respond(am.responses[0]) {
+			break
+		}
+		am.responses = am.responses[1:]
+	}
+}
+
+func (am *aquareaMQTT) publishEvent(event map[string]string) bool {
+	for topic, value := range event {
+		err := am.mqttClient.publish(topic, false, value, nil)
+		if err != nil {
+			log.Printf("Fail to publish event on %s, %v", topic, err)
+			return false
+		}
+	}
+	return true
+}
+
+// Publishes retained values which differ from what was last published, and every
+// setting result as each one reports a command outcome.
+// While disconnected they are only stored, for the resync on connect.
+func (am *aquareaMQTT) publishChanges(data map[string]string, read map[string]time.Time) {
+	connected := am.mqttClient.connected()
 	for key, value := range data {
-		token := am.mqttClient.Publish(key, byte(0), true, value)
-		if token.Wait() && token.Error() != nil {
-			fmt.Printf("Fail to publish, %v", token.Error())
+		if last, ok := am.published[key]; ok && last == value && !am.resultTopic(key) {
+			continue
+		}
+		am.published[key] = value
+		am.read[key] = read[key]
+		if !connected {
+			continue
+		}
+		err := am.mqttClient.publish(key, true, value, am.stateProperties(key))
+		if err != nil {
+			log.Printf("Fail to publish, %v", err)
+			delete(am.published, key) // try again with next update
+		}
+	}
+}
+
+// aquarea/<id>/settings/<name>/result
+func (am *aquareaMQTT) resultTopic(topic string) bool {
+	_, category, name, ok := am.topics.parse(topic)
+	return ok && category == topicSettings && strings.HasSuffix(name, "/result")
+}
+
+// Publishes everything again: bridge status, discovery and all retained values
+func (am *aquareaMQTT) resync() {
+	am.setStatus(am.online)
+	am.publish(am.discoveryConfigs(), true)
+	if !am.mqttClient.connected() {
+		return
+	}
+	for key, value := range am.published {
+		err := am.mqttClient.publish(key, true, value, am.stateProperties(key))
+		if err != nil {
+			log.Printf("Fail to publish, %v", err)
+		}
+	}
+}
+
+// MQTT v5 user properties of a retained value: device and when the value was read
+// from Service Cloud (RFC 3339), as in command responses
+func (am *aquareaMQTT) stateProperties(topic string) *mqttProperties {
+	read := am.read[topic]
+	if read.IsZero() {
+		return nil
+	}
+	user := map[string]string{"timestamp": read.Format(time.RFC3339)}
+	if deviceID, _, _, ok := am.topics.parse(topic); ok {
+		user["device"] = deviceID
+	}
+	return &mqttProperties{user: user}
+}
+
+// Discovery configs currently published
+func (am *aquareaMQTT) discoveryConfigs() map[string]string {
+	am.discoveryLock.Lock()
+	defer am.discoveryLock.Unlock()
+	if am.discovery == nil {
+		return nil
+	}
+	return am.discovery.configs
+}
+
+// Answers an MQTT v5 command on its response topic; tells whether the broker took it
+func (am *aquareaMQTT) respond(response mqttResponse) bool {
+	err := am.mqttClient.publish(response.request.responseTopic, false, response.payload, &mqttProperties{
+		correlationData: response.request.correlationData,
+		user:            response.user,
+	})
+	if err != nil {
+		log.Printf("Fail to respond on %s, %v", response.request.responseTopic, err)
+		return false
+	}
+	return true
+}
+
+// Home Assistant birth message - it may have lost non-retained discovery, so send it again
+func (am *aquareaMQTT) handleHAStatus(msg mqttMessage) {
+	if string(msg.payload) != "online" {
+		return
+	}
+	select {
+	case am.haOnline <- true:
+	default:
+		// republish already pending
+	}
+}
+
+// Collects discovery configs published by this bridge in an earlier run, so that the ones
+// no longer needed can be removed. Ours have the device ID in the topic and as device identifier.
+func (am *aquareaMQTT) handleRetainedDiscovery(msg mqttMessage) {
+	if !msg.retained || len(msg.payload) == 0 {
+		return
+	}
+	var config struct {
+		Device struct {
+			Model       string `json:"model"`
+			Identifiers string `json:"identifiers"`
+		} `json:"device"`
+	}
+	if json.Unmarshal(msg.payload, &config) != nil {
+		return
+	}
+	deviceID, ok := am.topics.parseDiscovery(msg.topic)
+	if !ok || config.Device.Model != "Aquarea" || config.Device.Identifiers != deviceID {
+		return
+	}
+
+	am.discoveryLock.Lock()
+	defer am.discoveryLock.Unlock()
+	if am.discovery != nil && am.discovery.stale(msg.topic) {
+		log.Printf("Removing stale discovery %s", msg.topic)
+		am.mqttClient.publish(msg.topic, true, "", nil)
+	} else if am.discovery == nil || am.discovery.configs[msg.topic] == "" {
+		// nothing published yet, or its device not read - decided in publishDiscovery
+		am.retainedDiscovery[msg.topic] = true
+	}
+}
+
+// Publishes discovery configs. Configs published before, here or in an earlier run, are
+// removed once they are no longer backed by a device or setting, so that Home Assistant
+// drops their entities. Configs of devices which could not be read are left alone.
+func (am *aquareaMQTT) publishDiscovery(set mqttDiscoverySet) {
+	stale := make(map[string]string)
+	am.discoveryLock.Lock()
+	merged := set.update(am.discovery)
+	published := make(map[string]bool)
+	for topic := range am.retainedDiscovery {
+		published[topic] = true
+	}
+	if am.discovery != nil {
+		for topic := range am.discovery.configs {
+			published[topic] = true
+		}
+	}
+	for topic := range published {
+		if merged.stale(topic) {
+			stale[topic] = ""
+			delete(am.retainedDiscovery, topic)
+		} else if _, ok := merged.configs[topic]; ok {
+			delete(am.retainedDiscovery, topic)
 		}
 	}
+	am.discovery = &merged
+	am.discoveryLock.Unlock()
+
+	am.publish(set.configs, true)
+	if len(stale) > 0 {
+		log.Printf("Removing %d stale discovery configs", len(stale))
+		am.publish(stale, true)
+	}
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT client of either protocol version, so that handlers do not depend on the library
+type mqttClient interface {
+	publish(topic string, retained bool, payload string, properties *mqttProperties) error
+	connected() bool
+	disconnect()
+}
+
+// Backoff of connection attempts
+const (
+	mqttRetryMin = 1 * time.Second
+	mqttRetryMax = 2 * time.Minute
+)
+
+// Received message. Response topic and correlation data come with MQTT v5 requests only.
+type mqttMessage struct {
+	topic           string
+	payload         []byte
+	retained        bool
+	responseTopic   string
+	correlationData []byte
+}
+
+// MQTT v5 properties of a published message; MQTT v3 has no place for them
+type mqttProperties struct {
+	correlationData []byte
+	user            map[string]string
+}
+
+type mqttSubscription struct {
+	topic   string
+	qos     byte
+	handler func(mqttMessage)
+}
+
+// Connection parameters common to both protocol versions
+type mqttConnOptions struct {
+	brokerURL     string
+	tlsConfig     *tls.Config
+	login         string
+	password      string
+	clientID      string
+	keepalive     time.Duration
+	willTopic     string             // gets a retained offline when the connection is lost
+	onConnect     func()             // after every (re)connect
+	subscriptions []mqttSubscription // renewed on every (re)connect
+}
+
+// MQTT protocol version from the config: 3 (default, 3.1.1) or 5
+func mqttProtocolVersion(config configType) (int, error) {
+	switch config.MqttVersion {
+	case 0, 3, 4:
+		return 3, nil
+	case 5:
+		return 5, nil
+	}
+	return 0, fmt.Errorf("Unsupported MQTT version %d, use 3 or 5", config.MqttVersion)
+}
+
+// User properties in a stable order
+func (p *mqttProperties) sortedUser() [][2]string {
+	var user [][2]string
+	for key, value := range p.user {
+		user = append(user, [2]string{key, value})
+	}
+	sort.Slice(user, func(i, j int) bool { return user[i][0] < user[j][0] })
+	return user
+}
+
+type mqttClientV3 struct {
+	client mqtt.Client
+	stop   chan struct{}
+}
+
+func newMQTTClientV3(options mqttConnOptions) *mqttClientV3 {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(options.brokerURL)
+	opts.SetTLSConfig(options.tlsConfig)
+	opts.SetPassword(options.password)
+	opts.SetUsername(options.login)
+	opts.SetClientID(options.clientID)
+	opts.SetKeepAlive(options.keepalive)
+
+	opts.SetCleanSession(true)  // don't want to receive entire backlog of setting changes
+	opts.SetAutoReconnect(true) // default, but I want it explicit
+	opts.SetMaxReconnectInterval(mqttRetryMax)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		options.onConnect()
+		for _, s := range options.subscriptions {
+			handler := s.handler
+			c.Subscribe(s.topic, s.qos, func(c mqtt.Client, msg mqtt.Message) {
+				handler(mqttMessage{topic: msg.Topic(), payload: msg.Payload(), retained: msg.Retained()})
+			})
+		}
+	})
+
+	opts.SetWill(options.willTopic, "offline", byte(0), true)
+
+	mc := &mqttClientV3{client: mqtt.NewClient(opts), stop: make(chan struct{})}
+	go mc.connect()
+	return mc
+}
+
+// First connection, retried with backoff till the broker is there; paho reconnects by itself later
+func (mc *mqttClientV3) connect() {
+	retry := mqttRetryMin
+	for {
+		token := mc.client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		log.Printf("MQTT connection failed, %v; retrying in %v", token.Error(), retry)
+		select {
+		case <-time.After(retry):
+		case <-mc.stop:
+			return
+		}
+		retry *= 2
+		if retry > mqttRetryMax {
+			retry = mqttRetryMax
+		}
+	}
+}
+
+func (mc *mqttClientV3) publish(topic string, retained bool, payload string, properties *mqttProperties) error {
+	token := mc.client.Publish(topic, byte(0), retained, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func (mc *mqttClientV3) connected() bool {
+	return mc.client.IsConnectionOpen()
+}
+
+func (mc *mqttClientV3) disconnect() {
+	close(mc.stop)
+	mc.client.Disconnect(2000)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const mqttConnectTimeout = 10 * time.Second
+
+type mqttClientV5 struct {
+	cm    *autopaho.ConnectionManager
+	up    int32 // connection state, atomic
+	retry time.Duration
+	stop  chan struct{}
+}
+
+func newMQTTClientV5(options mqttConnOptions) (*mqttClientV5, error) {
+	mc := &mqttClientV5{retry: mqttRetryMin, stop: make(chan struct{})}
+	brokerURL, err := url.Parse(options.brokerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	router := paho.NewStandardRouter()
+	subscribe := &paho.Subscribe{}
+	for _, s := range options.subscriptions {
+		handler := s.handler
+		router.RegisterHandler(s.topic, func(p *paho.Publish) {
+			msg := mqttMessage{topic: p.Topic, payload: p.Payload, retained: p.Retain}
+			if p.Properties != nil {
+				msg.responseTopic = p.Properties.ResponseTopic
+				msg.correlationData = p.Properties.CorrelationData
+			}
+			handler(msg)
+		})
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: s.topic, QoS: s.qos})
+	}
+
+	config := autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{brokerURL},
+		TlsCfg:            options.tlsConfig,
+		KeepAlive:         uint16(options.keepalive.Seconds()),
+		ConnectTimeout:    mqttConnectTimeout,
+		ConnectRetryDelay: mqttRetryMin,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			atomic.StoreInt32(&mc.up, 1)
+			mc.retry = mqttRetryMin
+			options.onConnect()
+			if _, err := cm.Subscribe(context.Background(), subscribe); err != nil {
+				log.Printf("Fail to subscribe, %v", err)
+			}
+		},
+		OnConnectError: mc.backoff,
+		ClientConfig: paho.ClientConfig{
+			ClientID:           options.clientID,
+			Router:             router,
+			OnClientError:      func(error) { atomic.StoreInt32(&mc.up, 0) },
+			OnServerDisconnect: func(*paho.Disconnect) { atomic.StoreInt32(&mc.up, 0) },
+		},
+	}
+	config.SetUsernamePassword(options.login, []byte(options.password))
+	config.SetWillMessage(options.willTopic, []byte("offline"), 0, true)
+
+	// connects and reconnects in the background
+	mc.cm, err = autopaho.NewConnection(context.Background(), config)
+	if err != nil {
+		return nil, err
+	}
+	return mc, nil
+}
+
+// Called by autopaho after each failed attempt, before its own ConnectRetryDelay.
+// Waiting here makes the delay grow.
+func (mc *mqttClientV5) backoff(err error) {
+	atomic.StoreInt32(&mc.up, 0)
+	log.Printf("MQTT connection failed, %v; retrying in %v", err, mc.retry)
+	select {
+	case <-time.After(mc.retry - mqttRetryMin):
+	case <-mc.stop:
+	}
+	mc.retry *= 2
+	if mc.retry > mqttRetryMax {
+		mc.retry = mqttRetryMax
+	}
+}
+
+func (mc *mqttClientV5) publish(topic string, retained bool, payload string, properties *mqttProperties) error {
+	p := &paho.Publish{
+		Topic:   topic,
+		Retain:  retained,
+		Payload: []byte(payload),
+	}
+	if properties != nil {
+		p.Properties = &paho.PublishProperties{CorrelationData: properties.correlationData}
+		for _, kv := range properties.sortedUser() {
+			p.Properties.User.Add(kv[0], kv[1])
+		}
+	}
+	_, err := mc.cm.Publish(context.Background(), p)
+	return err
+}
+
+func (mc *mqttClientV5) connected() bool {
+	return atomic.LoadInt32(&mc.up) == 1
+}
+
+func (mc *mqttClientV5) disconnect() {
+	close(mc.stop)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	mc.cm.Disconnect(ctx)
+}
@@ -3,18 +3,104 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
+type mqttAvailability struct {
+	Topic string `json:"topic"`
+}
+
+// Entities are available while the bridge is logged in and their device is connected
+func (aq *aquarea) availability(id string) []mqttAvailability {
+	return []mqttAvailability{
+		{Topic: aq.topics.bridge("status")},
+		{Topic: aq.topics.device(id, topicStatus)},
+	}
+}
+
+// Home Assistant discovery configs of all devices linked to the account. A config
+// published before is removed when its device is gone, or when all data of its device
+// was read and the config is not in the set any more.
+type mqttDiscoverySet struct {
+	configs map[string]string
+	devices map[string]bool // linked devices, true if all their data was read
+}
+
+// Device ID of a discovery topic of any prefix
+func discoveryDevice(topic string) string {
+	values, _ := discoveryTopics.match(topic)
+	return values["device"]
+}
+
+// Whether a config published before is no longer backed by a device or setting
+func (set *mqttDiscoverySet) stale(topic string) bool {
+	if _, ok := set.configs[topic]; ok {
+		return false
+	}
+	read, linked := set.devices[discoveryDevice(topic)]
+	return !linked || read
+}
+
+// The set over an older one: configs of devices the set could not fully read are kept
+func (set mqttDiscoverySet) update(older *mqttDiscoverySet) mqttDiscoverySet {
+	if older == nil {
+		return set
+	}
+	merged := mqttDiscoverySet{configs: make(map[string]string), devices: make(map[string]bool)}
+	for id, read := range set.devices {
+		merged.devices[id] = read || older.devices[id]
+	}
+	for topic, config := range older.configs {
+		if read, linked := set.devices[discoveryDevice(topic)]; linked && !read {
+			merged.configs[topic] = config
+		}
+	}
+	for topic, config := range set.configs {
+		merged.configs[topic] = config
+	}
+	return merged
+}
+
+// Home Assistant device and state classes for log item units. Service Cloud reports
+// energy in kW per log interval, which is power to Home Assistant; energy counters
+// in kWh are integrated from it, see integrateEnergy.
+var unitClasses = map[string]struct{ deviceClass, stateClass string }{
+	"°C":    {"temperature", "measurement"},
+	"kW":    {"power", "measurement"},
+	"W":     {"power", "measurement"},
+	"kWh":   {"energy", "total_increasing"},
+	"Hz":    {"frequency", "measurement"},
+	"L/min": {"volume_flow_rate", "measurement"},
+	"r/min": {"", "measurement"},
+	"h":     {"duration", "total_increasing"},
+}
+
+// Home Assistant wants numbers from sensors with a unit or a state class. A value not numeric
+// at discovery makes a plain text sensor; a numeric one turns unknown instead of failing
+// when Service Cloud sends a placeholder such as "-" later.
+const numericValueTemplate = "{{ value if value | is_number else None }}"
+
+func isNumeric(value string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return err == nil
+}
+
+// Log items which are about the bridge or the device rather than the heating
+var diagnosticLogItems = map[string]bool{
+	"Timestamp": true,
+}
+
 type mqttSwitch struct {
-	Name              string `json:"name,omitempty"`
-	AvailabilityTopic string `json:"availability_topic,omitempty"`
-	CommandTopic      string `json:"command_topic,omitempty"`
-	StateTopic        string `json:"state_topic,omitempty"`
-	PayloadOn         string `json:"payload_on,omitempty"`
-	PayloadOff        string `json:"payload_off,omitempty"`
-	UniqueID          string `json:"unique_id,omitempty"`
-	Device            struct {
+	Name             string             `json:"name,omitempty"`
+	Availability     []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode string             `json:"availability_mode,omitempty"`
+	CommandTopic     string             `json:"command_topic,omitempty"`
+	StateTopic       string             `json:"state_topic,omitempty"`
+	PayloadOn        string             `json:"payload_on,omitempty"`
+	PayloadOff       string             `json:"payload_off,omitempty"`
+	UniqueID         string             `json:"unique_id,omitempty"`
+	Device           struct {
 		Manufacturer string `json:"manufacturer,omitempty"`
 		Model        string `json:"model,omitempty"`
 		Name         string `json:"name,omitempty"`
@@ -23,14 +109,20 @@ type mqttSwitch struct {
 }
 
 type mqttSensor struct {
-	Name              string `json:"name,omitempty"`
-	AvailabilityTopic string `json:"availability_topic,omitempty"`
-	StateTopic        string `json:"state_topic"`
-	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
-	DeviceClass       string `json:"device_class,omitempty"`
-	ForceUpdate       bool   `json:"force_update,omitempty"`
-	UniqueID          string `json:"unique_id,omitempty"`
-	Device            struct {
+	Name                string             `json:"name,omitempty"`
+	Availability        []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode    string             `json:"availability_mode,omitempty"`
+	StateTopic          string             `json:"state_topic"`
+	ValueTemplate       string             `json:"value_template,omitempty"`
+	JSONAttributesTopic string             `json:"json_attributes_topic,omitempty"`
+	UnitOfMeasurement   string             `json:"unit_of_measurement,omitempty"`
+	DeviceClass         string             `json:"device_class,omitempty"`
+	StateClass          string             `json:"state_class,omitempty"`
+	EntityCategory      string             `json:"entity_category,omitempty"`
+	ForceUpdate         bool               `json:"force_update,omitempty"`
+	Icon                string             `json:"icon,omitempty"`
+	UniqueID            string             `json:"unique_id,omitempty"`
+	Device              struct {
 		Manufacturer string `json:"manufacturer,omitempty"`
 		Model        string `json:"model,omitempty"`
 		Name         string `json:"name,omitempty"`
@@ -39,14 +131,66 @@ type mqttSensor struct {
 }
 
 type mqttBinarySensor struct {
-	Name              string `json:"name,omitempty"`
-	AvailabilityTopic string `json:"availability_topic,omitempty"`
-	StateTopic        string `json:"state_topic"`
-	DeviceClass       string `json:"device_class,omitempty"`
-	ForceUpdate       bool   `json:"force_update,omitempty"`
-	PayloadOff        string `json:"payload_off,omitempty"`
-	PayloadOn         string `json:"payload_on,omitempty"`
-	UniqueID          string `json:"unique_id,omitempty"`
+	Name             string             `json:"name,omitempty"`
+	Availability     []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode string             `json:"availability_mode,omitempty"`
+	StateTopic       string             `json:"state_topic"`
+	DeviceClass      string             `json:"device_class,omitempty"`
+	EntityCategory   string             `json:"entity_category,omitempty"`
+	ForceUpdate      bool               `json:"force_update,omitempty"`
+	PayloadOff       string             `json:"payload_off,omitempty"`
+	PayloadOn        string             `json:"payload_on,omitempty"`
+	UniqueID         string             `json:"unique_id,omitempty"`
+	Device           struct {
+		Manufacturer string `json:"manufacturer,omitempty"`
+		Model        string `json:"model,omitempty"`
+		Name         string `json:"name,omitempty"`
+		Identifiers  string `json:"identifiers,omitempty"`
+	} `json:"device"`
+}
+
+type mqttSelect struct {
+	Name             string             `json:"name,omitempty"`
+	Availability     []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode string             `json:"availability_mode,omitempty"`
+	CommandTopic     string             `json:"command_topic,omitempty"`
+	StateTopic       string             `json:"state_topic,omitempty"`
+	Options          []string           `json:"options"`
+	UniqueID         string             `json:"unique_id,omitempty"`
+	Device           struct {
+		Manufacturer string `json:"manufacturer,omitempty"`
+		Model        string `json:"model,omitempty"`
+		Name         string `json:"name,omitempty"`
+		Identifiers  string `json:"identifiers,omitempty"`
+	} `json:"device"`
+}
+
+type mqttButton struct {
+	Name             string             `json:"name,omitempty"`
+	Availability     []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode string             `json:"availability_mode,omitempty"`
+	CommandTopic     string             `json:"command_topic,omitempty"`
+	PayloadPress     string             `json:"payload_press,omitempty"`
+	UniqueID         string             `json:"unique_id,omitempty"`
+	Device           struct {
+		Manufacturer string `json:"manufacturer,omitempty"`
+		Model        string `json:"model,omitempty"`
+		Name         string `json:"name,omitempty"`
+		Identifiers  string `json:"identifiers,omitempty"`
+	} `json:"device"`
+}
+
+type mqttNumber struct {
+	Name              string             `json:"name,omitempty"`
+	Availability      []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode  string             `json:"availability_mode,omitempty"`
+	CommandTopic      string             `json:"command_topic,omitempty"`
+	StateTopic        string             `json:"state_topic,omitempty"`
+	Min               int                `json:"min"`
+	Max               int                `json:"max"`
+	Step              int                `json:"step,omitempty"`
+	UnitOfMeasurement string             `json:"unit_of_measurement,omitempty"`
+	UniqueID          string             `json:"unique_id,omitempty"`
 	Device            struct {
 		Manufacturer string `json:"manufacturer,omitempty"`
 		Model        string `json:"model,omitempty"`
@@ -55,40 +199,217 @@ type mqttBinarySensor struct {
 	} `json:"device"`
 }
 
+type mqttClimate struct {
+	Name                    string             `json:"name,omitempty"`
+	Availability            []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode        string             `json:"availability_mode,omitempty"`
+	CurrentTemperatureTopic string             `json:"current_temperature_topic,omitempty"`
+	TemperatureStateTopic   string             `json:"temperature_state_topic,omitempty"`
+	TemperatureCommandTopic string             `json:"temperature_command_topic,omitempty"`
+	ModeStateTopic          string             `json:"mode_state_topic,omitempty"`
+	ModeCommandTopic        string             `json:"mode_command_topic,omitempty"`
+	Modes                   []string           `json:"modes,omitempty"`
+	MinTemp                 int                `json:"min_temp"`
+	MaxTemp                 int                `json:"max_temp"`
+	TempStep                float64            `json:"temp_step,omitempty"`
+	Precision               float64            `json:"precision,omitempty"`
+	TemperatureUnit         string             `json:"temperature_unit,omitempty"`
+	UniqueID                string             `json:"unique_id,omitempty"`
+	Device                  struct {
+		Manufacturer string `json:"manufacturer,omitempty"`
+		Model        string `json:"model,omitempty"`
+		Name         string `json:"name,omitempty"`
+		Identifiers  string `json:"identifiers,omitempty"`
+	} `json:"device"`
+}
+
+type mqttWaterHeater struct {
+	Name                    string             `json:"name,omitempty"`
+	Availability            []mqttAvailability `json:"availability,omitempty"`
+	AvailabilityMode        string             `json:"availability_mode,omitempty"`
+	CurrentTemperatureTopic string             `json:"current_temperature_topic,omitempty"`
+	TemperatureStateTopic   string             `json:"temperature_state_topic,omitempty"`
+	TemperatureCommandTopic string             `json:"temperature_command_topic,omitempty"`
+	ModeStateTopic          string             `json:"mode_state_topic,omitempty"`
+	ModeCommandTopic        string             `json:"mode_command_topic,omitempty"`
+	Modes                   []string           `json:"modes,omitempty"`
+	MinTemp                 int                `json:"min_temp"`
+	MaxTemp                 int                `json:"max_temp"`
+	Precision               float64            `json:"precision,omitempty"`
+	TemperatureUnit         string             `json:"temperature_unit,omitempty"`
+	UniqueID                string             `json:"unique_id,omitempty"`
+	Device                  struct {
+		Manufacturer string `json:"manufacturer,omitempty"`
+		Model        string `json:"model,omitempty"`
+		Name         string `json:"name,omitempty"`
+		Identifiers  string `json:"identifiers,omitempty"`
+	} `json:"device"`
+}
+
 func (aq *aquarea) encodeSwitches(topics map[string]string, user aquareaEndUserJSON) map[string]string {
 	config := make(map[string]string)
 
 	for k, v := range topics {
-		if strings.Contains(k, "/settings/") && strings.HasSuffix(k, "/options") {
-			topicSplit := strings.Split(k, "/")
-			name := topicSplit[3]
-			deviceID := topicSplit[1]
+		deviceID, category, name, ok := aq.topics.parse(k)
+		if !ok || category != topicSettings {
+			continue
+		}
+		if strings.HasSuffix(name, "/options") {
+			name = strings.TrimSuffix(name, "/options")
 			values := strings.Split(v, "\n")
+			if description, ok := aq.translation[aq.reverseTranslation[name]]; ok && description.Button != nil && aq.requestOnly(name) {
+				// see encodeButtons
+				continue
+			}
 			if len(values) <= 2 && len(values) > 0 {
 				// 1 or 2 possible values - encode as a switch
-				haTopic, haData, err := encodeSwitch(name, deviceID, strings.TrimSuffix(k, "/options"), values)
+				haTopic, haData, err := aq.encodeSwitch(name, deviceID, strings.TrimSuffix(k, "/options"), values)
 				if err == nil {
 					// send to MQTT
 					config[haTopic] = string(haData)
 				}
 			} else if len(values) > 2 {
-				// TODO multi (more than 2) state switch
-				// TODO numeric value settings
-				// seems to be not possible currently: a Helper and Automation is required
+				// more values - encode as a select
+				haTopic, haData, err := aq.encodeSelect(name, deviceID, strings.TrimSuffix(k, "/options"), values)
+				if err == nil {
+					config[haTopic] = string(haData)
+				}
+			}
+		} else if !strings.Contains(name, "/") {
+			description, ok := aq.translation[aq.reverseTranslation[name]]
+			if !ok || description.Kind != "placeholder" {
+				continue
+			}
+			// numeric value - encode as a number
+			min, max := description.limits()
+			haTopic, haData, err := aq.encodeNumber(name, deviceID, k, min, max, description.step(), description.Unit)
+			if err == nil {
+				config[haTopic] = string(haData)
+			}
+		}
+	}
+
+	return config
+}
+
+// Settings with no Off value, which can only be requested
+func (aq *aquarea) requestOnly(name string) bool {
+	return aq.optionContaining(name, "Off") == ""
+}
+
+// One-shot requests (ForceDefrost) as buttons, with a binary sensor telling if the action runs.
+// Settings which can be turned off (ForceDHW, ForceHeater) stay switches and only get the sensor
+func (aq *aquarea) encodeButtons(topics map[string]string, user aquareaEndUserJSON) map[string]string {
+	config := make(map[string]string)
+	for _, description := range aq.translation {
+		if description.Button == nil {
+			continue
+		}
+		settingTopic := aq.topics.device(user.Gwid, topicSettings, description.Name)
+		if _, ok := topics[settingTopic]; !ok {
+			continue
+		}
+		if aq.requestOnly(description.Name) {
+			payload := aq.optionContaining(description.Name, "Request")
+			if payload == "" {
+				payload = aq.optionContaining(description.Name, "On")
+			}
+			haTopic, haData, err := aq.encodeButton(description.Name, user.Gwid, settingTopic, payload)
+			if err == nil {
+				config[haTopic] = string(haData)
 			}
 		}
+
+		statusTopic := settingTopic
+		if description.Button.Status != "" {
+			statusTopic = aq.topics.device(user.Gwid, topicState, description.Button.Status)
+		}
+		haTopic, haData, err := aq.encodeBinarySensor(description.Name+"Active", user.Gwid, statusTopic, description.Button.On, description.Button.Off)
+		if err == nil {
+			config[haTopic] = string(haData)
+		}
+	}
+	return config
+}
+
+// One climate entity per zone in use by ZoneOperationSetting, built on the HVACMode
+// and ZoneNTargetTemperature virtual settings
+func (aq *aquarea) encodeClimates(topics map[string]string, user aquareaEndUserJSON) map[string]string {
+	config := make(map[string]string)
+	modeTopic := aq.topics.device(user.Gwid, topicSettings, hvacModeSetting)
+	if _, ok := topics[modeTopic]; !ok {
+		return config
+	}
+
+	modes := []string{"off"}
+	for _, label := range aq.settingOptions("OperationMode") {
+		mode := hvacMode("On", label)
+		found := false
+		for _, m := range modes {
+			found = found || m == mode
+		}
+		if !found {
+			modes = append(modes, mode)
+		}
+	}
+
+	zoneOperation := topics[aq.topics.device(user.Gwid, topicSettings, "ZoneOperationSetting")]
+	for _, zone := range climateZones {
+		if !strings.Contains(zoneOperation, strconv.Itoa(zone)) {
+			// zone not in use
+			continue
+		}
+		targetTopic := aq.topics.device(user.Gwid, topicSettings, fmt.Sprintf(zoneTargetSetting, zone))
+		if _, ok := topics[targetTopic]; !ok {
+			continue
+		}
+
+		// the target accepts both heat and cool values
+		heatMin, heatMax := aq.settingLimits(zoneTargetName(zone, "heat"))
+		coolMin, coolMax := aq.settingLimits(zoneTargetName(zone, "cool"))
+		if coolMin < heatMin {
+			heatMin = coolMin
+		}
+		if coolMax > heatMax {
+			heatMax = coolMax
+		}
+
+		name := fmt.Sprintf("Zone%d", zone)
+		currentTopic := aq.topics.device(user.Gwid, topicState, fmt.Sprintf("Zone%dTemperatureActual", zone))
+		haTopic, haData, err := aq.encodeClimate(name, user.Gwid, currentTopic, targetTopic, modeTopic, modes, heatMin, heatMax)
+		if err == nil {
+			config[haTopic] = string(haData)
+		}
+	}
+	return config
+}
+
+// DHW tank as a water heater, built on the DHWMode virtual setting and TankTargetTemperature
+func (aq *aquarea) encodeWaterHeaters(topics map[string]string, user aquareaEndUserJSON) map[string]string {
+	config := make(map[string]string)
+	modeTopic := aq.topics.device(user.Gwid, topicSettings, dhwModeSetting)
+	targetTopic := aq.topics.device(user.Gwid, topicSettings, "TankTargetTemperature")
+	if _, ok := topics[modeTopic]; !ok {
+		return config
+	}
+	if _, ok := topics[targetTopic]; !ok {
+		return config
 	}
 
+	minTemp, maxTemp := aq.settingLimits("TankTargetTemperature")
+	currentTopic := aq.topics.device(user.Gwid, topicState, "DHWTankTemperatureActual")
+	haTopic, haData, err := aq.encodeWaterHeater("DHW", user.Gwid, currentTopic, targetTopic, modeTopic, dhwModes, minTemp, maxTemp)
+	if err == nil {
+		config[haTopic] = string(haData)
+	}
 	return config
-	//aquarea/B25xxx/settings/Operation
-	//homeassistant/switch/B2500423423/Operation/config
 }
 
 func (aq *aquarea) encodeSensors(topics map[string]string, user aquareaEndUserJSON) map[string]string {
 	config := make(map[string]string)
 	topicsNoDuplicates := make(map[string]string)
 	for k, v := range topics {
-		if !strings.Contains(k, "/log/") {
+		if _, category, _, ok := aq.topics.parse(k); !ok || category != topicLog {
 			continue
 		}
 		if strings.HasSuffix(k, "/unit") {
@@ -101,13 +422,13 @@ func (aq *aquarea) encodeSensors(topics map[string]string, user aquareaEndUserJS
 	}
 
 	for k, v := range topicsNoDuplicates {
-		topicSplit := strings.Split(k, "/")
-		name := topicSplit[3]
-		deviceID := topicSplit[1]
+		deviceID, _, name, _ := aq.topics.parse(k)
+		name = strings.TrimSuffix(name, "/unit")
 		if strings.HasSuffix(k, "/unit") {
 
 			// v contains the unit
-			haTopic, haData, err := encodeSensor(name, deviceID, strings.TrimSuffix(k, "/unit"), v)
+			stateTopic := strings.TrimSuffix(k, "/unit")
+			haTopic, haData, err := aq.encodeSensor(name, deviceID, stateTopic, v, topics[stateTopic])
 			if err == nil {
 				// send to MQTT
 				config[haTopic] = string(haData)
@@ -115,14 +436,14 @@ func (aq *aquarea) encodeSensors(topics map[string]string, user aquareaEndUserJS
 		} else {
 			if v == "On" || v == "Off" {
 				// encode as binary sensor
-				haTopic, haData, err := encodeBinarySensor(name, deviceID, k)
+				haTopic, haData, err := aq.encodeBinarySensor(name, deviceID, k, "On", "Off")
 				if err == nil {
 					// send to MQTT
 					config[haTopic] = string(haData)
 				}
 			} else {
 				// encode as sensor
-				haTopic, haData, err := encodeSensor(name, deviceID, k, "")
+				haTopic, haData, err := aq.encodeSensor(name, deviceID, k, "", v)
 				if err == nil {
 					// send to MQTT
 					config[haTopic] = string(haData)
@@ -132,56 +453,243 @@ func (aq *aquarea) encodeSensors(topics map[string]string, user aquareaEndUserJS
 	}
 
 	return config
+}
+
+// Sensors for the status page, with units and device classes from translation.json.
+// Named like the log items in places, so they get their own state_ object IDs.
+func (aq *aquarea) encodeStatusSensors(topics map[string]string, user aquareaEndUserJSON) map[string]string {
+	config := make(map[string]string)
+	descriptions := make(map[string]aquareaFunctionDescription)
+	for key, description := range aq.translation {
+		if strings.HasPrefix(key, "function-status") {
+			descriptions[description.Name] = *description
+		}
+	}
+
+	for k, v := range topics {
+		_, category, name, ok := aq.topics.parse(k)
+		if !ok || category != topicState {
+			continue
+		}
+		description := descriptions[name]
+		haTopic, haData, err := aq.encodeStatusSensor(name, user.Gwid, k, v, description)
+		if err == nil {
+			config[haTopic] = string(haData)
+		}
+	}
+	return config
+}
 
-	//aquarea/B25xxx/log
-	//homeassistant/sensor/B2500423423/Operation/config
+func (aq *aquarea) encodeStatusSensor(name, id, stateTopic, value string, description aquareaFunctionDescription) (string, []byte, error) {
+	objectID := "state_" + name
+	var s interface{}
+	var component string
+	if value == "On" || value == "Off" {
+		var b mqttBinarySensor
+		b.Name = name
+		b.Availability = aq.availability(id)
+		b.AvailabilityMode = "all"
+		b.StateTopic = stateTopic
+		b.DeviceClass = description.DeviceClass
+		b.EntityCategory = description.EntityCategory
+		b.PayloadOn = "On"
+		b.PayloadOff = "Off"
+		b.UniqueID = id + "_" + objectID
+		b.Device.Manufacturer = "Panasonic"
+		b.Device.Model = "Aquarea"
+		b.Device.Identifiers = id
+		b.Device.Name = "Aquarea " + id
+		s, component = b, "binary_sensor"
+	} else {
+		var t mqttSensor
+		t.Name = name
+		t.Availability = aq.availability(id)
+		t.AvailabilityMode = "all"
+		t.StateTopic = stateTopic
+		if isNumeric(value) {
+			t.ValueTemplate = numericValueTemplate
+			t.UnitOfMeasurement = description.Unit
+			t.DeviceClass = description.DeviceClass
+			t.StateClass = description.StateClass
+		}
+		t.EntityCategory = description.EntityCategory
+		t.UniqueID = id + "_" + objectID
+		t.Device.Manufacturer = "Panasonic"
+		t.Device.Model = "Aquarea"
+		t.Device.Identifiers = id
+		t.Device.Name = "Aquarea " + id
+		s, component = t, "sensor"
+	}
+
+	topic := aq.topics.discovery(component, id, objectID)
+	data, err := json.Marshal(s)
+
+	return topic, data, err
 }
 
-func encodeBinarySensor(name, id, stateTopic string) (string, []byte, error) {
+func (aq *aquarea) encodeBinarySensor(name, id, stateTopic, payloadOn, payloadOff string) (string, []byte, error) {
 	var s mqttBinarySensor
 	s.Name = name
-	s.AvailabilityTopic = "aquarea/status"
+	s.Availability = aq.availability(id)
+	s.AvailabilityMode = "all"
+	s.StateTopic = stateTopic
+	s.PayloadOn = payloadOn
+	s.PayloadOff = payloadOff
+	s.UniqueID = id + "_" + name
+	s.Device.Manufacturer = "Panasonic"
+	s.Device.Model = "Aquarea"
+	s.Device.Identifiers = id
+	s.Device.Name = "Aquarea " + id
+
+	topic := aq.topics.discovery("binary_sensor", id, name)
+	data, err := json.Marshal(s)
+
+	return topic, data, err
+}
+
+// Log item sensor; classes come from translation.json if it describes the item, else from the unit
+func (aq *aquarea) encodeSensor(name, id, stateTopic, unit, value string) (string, []byte, error) {
+	var s mqttSensor
+	s.Name = name
+	s.Availability = aq.availability(id)
+	s.AvailabilityMode = "all"
 	s.StateTopic = stateTopic
-	s.PayloadOn = "On"
-	s.PayloadOff = "Off"
+	if isNumeric(value) {
+		s.ValueTemplate = numericValueTemplate
+		s.UnitOfMeasurement = unit
+		s.DeviceClass = unitClasses[unit].deviceClass
+		s.StateClass = unitClasses[unit].stateClass
+		if description := aq.logItemDescription(name); description != nil && description.DeviceClass != "" {
+			s.DeviceClass = description.DeviceClass
+			s.StateClass = description.StateClass
+		}
+	}
+	if diagnosticLogItems[name] {
+		s.EntityCategory = "diagnostic"
+	}
+	if description := aq.logItemDescription(name); description != nil && description.EntityCategory != "" {
+		s.EntityCategory = description.EntityCategory
+	}
 	s.UniqueID = id + "_" + name
 	s.Device.Manufacturer = "Panasonic"
 	s.Device.Model = "Aquarea"
 	s.Device.Identifiers = id
 	s.Device.Name = "Aquarea " + id
 
-	//	DeviceClass       string `json:"device_class,omitempty"`
-	//	ForceUpdate       bool   `json:"force_update,omitempty"`
-	topic := fmt.Sprintf("homeassistant/binary_sensor/%s/%s/config", id, name)
+	topic := aq.topics.discovery("sensor", id, name)
 	data, err := json.Marshal(s)
 
 	return topic, data, err
 }
 
-func encodeSensor(name, id, stateTopic, unit string) (string, []byte, error) {
+func (aq *aquarea) encodeClimate(name, id, currentTopic, targetTopic, modeTopic string, modes []string, minTemp, maxTemp int) (string, []byte, error) {
+	var c mqttClimate
+	c.Name = name
+	c.Availability = aq.availability(id)
+	c.AvailabilityMode = "all"
+	c.CurrentTemperatureTopic = currentTopic
+	c.TemperatureStateTopic = targetTopic
+	c.TemperatureCommandTopic = targetTopic + "/set"
+	c.ModeStateTopic = modeTopic
+	c.ModeCommandTopic = modeTopic + "/set"
+	c.Modes = modes
+	c.MinTemp = minTemp
+	c.MaxTemp = maxTemp
+	c.TempStep = 1
+	c.Precision = 1
+	c.TemperatureUnit = "C"
+	c.UniqueID = id + "_" + name + "_climate"
+	c.Device.Manufacturer = "Panasonic"
+	c.Device.Model = "Aquarea"
+	c.Device.Identifiers = id
+	c.Device.Name = "Aquarea " + id
+
+	topic := aq.topics.discovery("climate", id, name)
+	data, err := json.Marshal(c)
+
+	return topic, data, err
+}
+
+func (aq *aquarea) encodeWaterHeater(name, id, currentTopic, targetTopic, modeTopic string, modes []string, minTemp, maxTemp int) (string, []byte, error) {
+	var w mqttWaterHeater
+	w.Name = name
+	w.Availability = aq.availability(id)
+	w.AvailabilityMode = "all"
+	w.CurrentTemperatureTopic = currentTopic
+	w.TemperatureStateTopic = targetTopic
+	w.TemperatureCommandTopic = targetTopic + "/set"
+	w.ModeStateTopic = modeTopic
+	w.ModeCommandTopic = modeTopic + "/set"
+	w.Modes = modes
+	w.MinTemp = minTemp
+	w.MaxTemp = maxTemp
+	w.Precision = 1
+	w.TemperatureUnit = "C"
+	w.UniqueID = id + "_" + name + "_water_heater"
+	w.Device.Manufacturer = "Panasonic"
+	w.Device.Model = "Aquarea"
+	w.Device.Identifiers = id
+	w.Device.Name = "Aquarea " + id
+
+	topic := aq.topics.discovery("water_heater", id, name)
+	data, err := json.Marshal(w)
+
+	return topic, data, err
+}
+
+// LastError from the error history and CurrentError from the device list, with description,
+// severity and action from the catalogue as attributes
+func (aq *aquarea) encodeErrorSensors(id string) map[string]string {
+	config := make(map[string]string)
+	for name, stateTopic := range map[string]string{
+		"LastError":    aq.topics.device(id, topicErrors, "last"),
+		"CurrentError": aq.topics.device(id, topicErrors, "current"),
+	} {
+		haTopic, haData, err := aq.encodeErrorSensor(name, id, stateTopic)
+		if err == nil {
+			config[haTopic] = string(haData)
+		}
+	}
+	return config
+}
+
+// Power of the device from the device list, known without polling the device
+func (aq *aquarea) encodePowerSensor(id string) map[string]string {
+	config := make(map[string]string)
+	haTopic, haData, err := aq.encodeBinarySensor("Power", id, aq.topics.device(id, topicStatus, "power"), "On", "Off")
+	if err == nil {
+		config[haTopic] = string(haData)
+	}
+	return config
+}
+
+func (aq *aquarea) encodeErrorSensor(name, id, stateTopic string) (string, []byte, error) {
 	var s mqttSensor
 	s.Name = name
-	s.AvailabilityTopic = "aquarea/status"
+	s.Availability = aq.availability(id)
+	s.AvailabilityMode = "all"
 	s.StateTopic = stateTopic
-	s.UnitOfMeasurement = unit
+	s.ValueTemplate = "{{ value_json.code }}"
+	s.JSONAttributesTopic = s.StateTopic
+	s.Icon = "mdi:alert-circle"
+	s.EntityCategory = "diagnostic"
 	s.UniqueID = id + "_" + name
 	s.Device.Manufacturer = "Panasonic"
 	s.Device.Model = "Aquarea"
 	s.Device.Identifiers = id
 	s.Device.Name = "Aquarea " + id
 
-	//	DeviceClass       string `json:"device_class,omitempty"`
-	//	ForceUpdate       bool   `json:"force_update,omitempty"`
-	topic := fmt.Sprintf("homeassistant/sensor/%s/%s/config", id, name)
+	topic := aq.topics.discovery("sensor", id, name)
 	data, err := json.Marshal(s)
 
 	return topic, data, err
 }
 
-func encodeSwitch(name, id, stateTopic string, values []string) (string, []byte, error) {
+func (aq *aquarea) encodeSwitch(name, id, stateTopic string, values []string) (string, []byte, error) {
 	var b mqttSwitch
 	b.Name = name
-	b.AvailabilityTopic = "aquarea/status"
+	b.Availability = aq.availability(id)
+	b.AvailabilityMode = "all"
 	b.CommandTopic = stateTopic + "/set"
 	b.StateTopic = stateTopic
 	b.Device.Manufacturer = "Panasonic"
@@ -210,7 +718,69 @@ func encodeSwitch(name, id, stateTopic string, values []string) (string, []byte,
 		return "", nil, fmt.Errorf("Cannot encode switch")
 	}
 
-	topic := fmt.Sprintf("homeassistant/switch/%s/%s/config", id, name)
+	topic := aq.topics.discovery("switch", id, name)
+	data, err := json.Marshal(b)
+
+	return topic, data, err
+}
+
+func (aq *aquarea) encodeSelect(name, id, stateTopic string, values []string) (string, []byte, error) {
+	var s mqttSelect
+	s.Name = name
+	s.Availability = aq.availability(id)
+	s.AvailabilityMode = "all"
+	s.CommandTopic = stateTopic + "/set"
+	s.StateTopic = stateTopic
+	s.Options = values
+	s.Device.Manufacturer = "Panasonic"
+	s.Device.Model = "Aquarea"
+	s.Device.Identifiers = id
+	s.Device.Name = "Aquarea " + id
+	s.UniqueID = id + "_" + name
+
+	topic := aq.topics.discovery("select", id, name)
+	data, err := json.Marshal(s)
+
+	return topic, data, err
+}
+
+func (aq *aquarea) encodeNumber(name, id, stateTopic string, min, max, step int, unit string) (string, []byte, error) {
+	var n mqttNumber
+	n.Name = name
+	n.Availability = aq.availability(id)
+	n.AvailabilityMode = "all"
+	n.CommandTopic = stateTopic + "/set"
+	n.StateTopic = stateTopic
+	n.Min = min
+	n.Max = max
+	n.Step = step
+	n.UnitOfMeasurement = unit
+	n.Device.Manufacturer = "Panasonic"
+	n.Device.Model = "Aquarea"
+	n.Device.Identifiers = id
+	n.Device.Name = "Aquarea " + id
+	n.UniqueID = id + "_" + name
+
+	topic := aq.topics.discovery("number", id, name)
+	data, err := json.Marshal(n)
+
+	return topic, data, err
+}
+
+func (aq *aquarea) encodeButton(name, id, settingTopic, payload string) (string, []byte, error) {
+	var b mqttButton
+	b.Name = name
+	b.Availability = aq.availability(id)
+	b.AvailabilityMode = "all"
+	b.CommandTopic = settingTopic + "/set"
+	b.PayloadPress = payload
+	b.Device.Manufacturer = "Panasonic"
+	b.Device.Model = "Aquarea"
+	b.Device.Identifiers = id
+	b.Device.Name = "Aquarea " + id
+	b.UniqueID = id + "_" + name
+
+	topic := aq.topics.discovery("button", id, name)
 	data, err := json.Marshal(b)
 
 	return topic, data, err
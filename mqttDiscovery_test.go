@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestButtonState(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+	settings := readSettings(t, aq, cloud.gwid)
+	config := aq.encodeButtons(settings, aq.usersMap[cloud.gwid])
+
+	for name, state := range map[string]string{
+		"ForceDHW":     aq.topics.device(cloud.gwid, topicSettings, "ForceDHW"),
+		"ForceDefrost": aq.topics.device(cloud.gwid, topicState, "DefrostStatus"),
+	} {
+		var sensor mqttBinarySensor
+		if err := json.Unmarshal([]byte(config[aq.topics.discovery("binary_sensor", cloud.gwid, name+"Active")]), &sensor); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if sensor.StateTopic != state || sensor.PayloadOn != "On" {
+			t.Errorf("%sActive follows %s %s, want %s On", name, sensor.StateTopic, sensor.PayloadOn, state)
+		}
+	}
+
+	// only request-only settings are buttons, the ones with an Off value stay switches
+	switches := aq.encodeSwitches(settings, aq.usersMap[cloud.gwid])
+	for name, button := range map[string]bool{"ForceDHW": false, "ForceHeater": false, "ForceDefrost": true} {
+		if _, ok := config[aq.topics.discovery("button", cloud.gwid, name)]; ok != button {
+			t.Errorf("%s button %v, want %v", name, ok, button)
+		}
+		var s mqttSwitch
+		if data, ok := switches[aq.topics.discovery("switch", cloud.gwid, name)]; ok == button {
+			t.Errorf("%s switch %v, want %v", name, ok, !button)
+		} else if ok {
+			if err := json.Unmarshal([]byte(data), &s); err != nil || s.PayloadOff != "Off" {
+				t.Errorf("%s switch payload_off %q, want Off", name, s.PayloadOff)
+			}
+		}
+	}
+}
+
+func TestEnergyCounter(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+	user := aq.usersMap[cloud.gwid]
+	consumption := -1
+	for i, item := range aq.logItems {
+		if item.Name == "HeatModeEnergyConsumption" {
+			consumption = i
+		}
+	}
+	if consumption < 0 {
+		t.Fatal("no HeatModeEnergyConsumption log item")
+	}
+	row := func(power string) []string {
+		r := make([]string, len(aq.logItems))
+		r[consumption] = power
+		return r
+	}
+	counter := aq.topics.device(cloud.gwid, topicLog, "HeatModeEnergyConsumed")
+
+	// counting starts at the newest row, half an hour at 2 kW adds 1 kWh
+	delete(aq.energyCounters, cloud.gwid+"/HeatModeEnergyConsumption") // started by the login fetch
+	start := int64(1600000000000)
+	if energy := aq.integrateEnergy(user, map[int64][]string{start: row("5")}); energy[counter] != "0.000" || energy[counter+"/unit"] != "kWh" {
+		t.Errorf("first read %q %q, want 0.000 kWh", energy[counter], energy[counter+"/unit"])
+	}
+	halfHour := int64(30 * 60 * 1000)
+	energy := aq.integrateEnergy(user, map[int64][]string{start: row("5"), start + halfHour: row("2")})
+	if energy[counter] != "1.000" {
+		t.Errorf("after half an hour at 2 kW %q, want 1.000", energy[counter])
+	}
+
+	var sensor mqttSensor
+	config := aq.encodeSensors(energy, user)
+	if err := json.Unmarshal([]byte(config[aq.topics.discovery("sensor", cloud.gwid, "HeatModeEnergyConsumed")]), &sensor); err != nil {
+		t.Fatal(err)
+	}
+	if sensor.DeviceClass != "energy" || sensor.StateClass != "total_increasing" || sensor.UnitOfMeasurement != "kWh" {
+		t.Errorf("counter is %s %s in %s, want energy total_increasing in kWh", sensor.DeviceClass, sensor.StateClass, sensor.UnitOfMeasurement)
+	}
+}
+
+func TestStateClassNumericOnly(t *testing.T) {
+	cloud := newTestCloud(t)
+	aq := newLoggedInAquarea(t, cloud)
+	user := aq.usersMap[cloud.gwid]
+
+	for value, numeric := range map[string]bool{"21.5": true, "-": false, "": false} {
+		topic := aq.topics.device(cloud.gwid, topicState, "InletWater")
+		config := aq.encodeStatusSensors(map[string]string{topic: value}, user)
+		var sensor mqttSensor
+		if err := json.Unmarshal([]byte(config[aq.topics.discovery("sensor", cloud.gwid, "state_InletWater")]), &sensor); err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if (sensor.StateClass != "") != numeric || (sensor.UnitOfMeasurement != "") != numeric {
+			t.Errorf("%q: state class %q, unit %q", value, sensor.StateClass, sensor.UnitOfMeasurement)
+		}
+	}
+}
+
+func TestDiscoveryStale(t *testing.T) {
+	topic := func(device, object string) string {
+		return "homeassistant/sensor/" + device + "/" + object + "/config"
+	}
+	older := &mqttDiscoverySet{
+		configs: map[string]string{topic("A", "Gone"): "{}", topic("A", "Kept"): "{}", topic("B", "Unread"): "{}"},
+		devices: map[string]bool{"A": true, "B": true},
+	}
+	// B could not be read this time, C is new and unread, D is not linked any more
+	set := mqttDiscoverySet{
+		configs: map[string]string{topic("A", "Kept"): "{}"},
+		devices: map[string]bool{"A": true, "B": false, "C": false},
+	}.update(older)
+
+	for topic, stale := range map[string]bool{
+		topic("A", "Gone"):   true,
+		topic("A", "Kept"):   false,
+		topic("B", "Unread"): false,
+		topic("C", "Any"):    false,
+		topic("D", "Any"):    true,
+	} {
+		if set.stale(topic) != stale {
+			t.Errorf("%s stale %v, want %v", topic, !stale, stale)
+		}
+	}
+	if set.configs[topic("B", "Unread")] == "" || !set.devices["B"] {
+		t.Error("configs of the device not read this time dropped")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Broker URL for the configured protocol: tcp (default), ssl, ws or wss
+func mqttBrokerURL(config configType) (string, error) {
+	protocol := strings.ToLower(config.MqttProtocol)
+	switch protocol {
+	case "":
+		protocol = "tcp"
+	case "tcp", "ssl", "ws", "wss":
+	default:
+		return "", fmt.Errorf("Unsupported MQTT protocol %s, use tcp, ssl, ws or wss", config.MqttProtocol)
+	}
+	url := fmt.Sprintf("%s://%s:%v", protocol, config.MqttServer, config.MqttPort)
+	if protocol == "ws" || protocol == "wss" {
+		url += "/" + strings.TrimPrefix(config.MqttPath, "/")
+	}
+	return url, nil
+}
+
+// TLS settings for ssl and wss brokers: CA bundle, client certificate and server name.
+// Without a CA bundle the system roots are used.
+func mqttTLSConfig(config configType) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.MqttServerName,
+		InsecureSkipVerify: config.MqttInsecureSkipVerify,
+	}
+
+	if config.MqttCACert != "" {
+		pem, err := ioutil.ReadFile(config.MqttCACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.MqttCACert)
+		}
+	}
+
+	if config.MqttClientCert != "" || config.MqttClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.MqttClientCert, config.MqttClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Topic categories of a device. Their segment names can be changed in the config.
+const (
+	topicSettings = "settings"
+	topicState    = "state"
+	topicLog      = "log"
+	topicErrors   = "errors"
+	topicEvents   = "events"
+	topicStatus   = "status"
+)
+
+var topicCategories = []string{topicSettings, topicState, topicLog, topicErrors, topicEvents, topicStatus}
+
+const (
+	defaultTopicPrefix     = "aquarea"
+	defaultDiscoveryPrefix = "homeassistant"
+	defaultTopicTemplate   = "{prefix}/{device}/{category}/{name}"
+	discoveryTemplate      = "{discovery}/{component}/{device}/{object}/config"
+)
+
+// A topic template with {placeholders}, and the regular expression parsing topics built from it,
+// so that topics are made and read the same way
+type topicTemplate struct {
+	template string
+	pattern  *regexp.Regexp
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{(\w+)\}`)
+
+// Placeholders match the given expressions, a single level if there is none
+func compileTemplate(template string, exprs map[string]string) (topicTemplate, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, m := range placeholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		expr.WriteString(regexp.QuoteMeta(template[last:m[0]]))
+		last = m[1]
+		name := template[m[2]:m[3]]
+		e, ok := exprs[name]
+		if !ok {
+			e = "[^/]+"
+		}
+		fmt.Fprintf(&expr, "(?P<%s>%s)", name, e)
+	}
+	expr.WriteString(regexp.QuoteMeta(template[last:]))
+	expr.WriteString("$")
+	pattern, err := regexp.Compile(expr.String())
+	return topicTemplate{template, pattern}, err
+}
+
+// Topic with the placeholders replaced
+func (t topicTemplate) fill(values map[string]string) string {
+	return placeholderRegexp.ReplaceAllStringFunc(t.template, func(placeholder string) string {
+		return values[strings.Trim(placeholder, "{}")]
+	})
+}
+
+// Placeholder values of a topic
+func (t topicTemplate) match(topic string) (map[string]string, bool) {
+	m := t.pattern.FindStringSubmatch(topic)
+	if m == nil {
+		return nil, false
+	}
+	values := make(map[string]string)
+	for i, name := range t.pattern.SubexpNames() {
+		if name != "" {
+			values[name] = m[i]
+		}
+	}
+	return values, true
+}
+
+// Discovery topics of any prefix, so that the device ID can be read without a layout
+var discoveryTopics = func() topicTemplate {
+	t, err := compileTemplate(discoveryTemplate, map[string]string{"discovery": ".+"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return t
+}()
+
+// Where things are published, so that several bridges or a house naming scheme can share a broker.
+// Device topics follow a template with {prefix}, {device}, {category} and {name}; {name} comes last,
+// as it may hold several levels (Operation/options) and set commands are its subtopics.
+type topicLayout struct {
+	prefix          string
+	discoveryPrefix string
+	segments        map[string]string // category to segment name
+	devices         topicTemplate
+}
+
+func newTopicLayout(config configType) *topicLayout {
+	tl := &topicLayout{
+		prefix:          strings.Trim(config.TopicPrefix, "/"),
+		discoveryPrefix: strings.Trim(config.DiscoveryPrefix, "/"),
+		segments:        make(map[string]string),
+	}
+	if tl.prefix == "" {
+		tl.prefix = defaultTopicPrefix
+	}
+	if tl.discoveryPrefix == "" {
+		tl.discoveryPrefix = defaultDiscoveryPrefix
+	}
+	template := config.TopicTemplate
+	if template == "" {
+		template = defaultTopicTemplate
+	}
+	used := make(map[string]bool)
+	for _, category := range topicCategories {
+		segment := category
+		if s, ok := config.TopicSegments[category]; ok && s != "" {
+			segment = s
+		}
+		if strings.ContainsAny(segment, "/+#") {
+			log.Fatalf("Topic segment %s for %s must be a single level", segment, category)
+		}
+		if used[segment] {
+			log.Fatalf("Topic segment %s is used twice", segment)
+		}
+		tl.segments[category] = segment
+		used[segment] = true
+	}
+
+	err := tl.compile(template)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return tl
+}
+
+// Checks the device topic template and builds its parser: the prefix as configured,
+// a category one of the segment names, a name of any number of levels
+func (tl *topicLayout) compile(template string) error {
+	if !strings.HasSuffix(template, "/{name}") {
+		return fmt.Errorf("Topic template %s must end with /{name}", template)
+	}
+	for _, m := range placeholderRegexp.FindAllStringSubmatch(template, -1) {
+		switch m[1] {
+		case "prefix", "device", "category", "name":
+		default:
+			return fmt.Errorf("Topic template %s has unknown placeholder %s", template, m[0])
+		}
+	}
+	for _, required := range []string{"device", "category", "name"} {
+		if strings.Count(template, "{"+required+"}") != 1 {
+			return fmt.Errorf("Topic template %s must contain {%s} once", template, required)
+		}
+	}
+	if strings.Count(template, "{prefix}") > 1 {
+		return fmt.Errorf("Topic template %s must contain {prefix} once at most", template)
+	}
+
+	segments := make([]string, 0, len(tl.segments))
+	for _, segment := range tl.segments {
+		segments = append(segments, regexp.QuoteMeta(segment))
+	}
+	sort.Strings(segments)
+	var err error
+	tl.devices, err = compileTemplate(template, map[string]string{
+		"prefix":   regexp.QuoteMeta(tl.prefix),
+		"category": strings.Join(segments, "|"),
+		"name":     ".+",
+	})
+	return err
+}
+
+// Topic of a device; without a name for the category topic itself (errors, events, status)
+func (tl *topicLayout) device(id, category string, name ...string) string {
+	topic := tl.devices.fill(map[string]string{
+		"prefix":   tl.prefix,
+		"device":   id,
+		"category": tl.segments[category],
+		"name":     strings.Join(name, "/"),
+	})
+	return strings.TrimSuffix(topic, "/")
+}
+
+// Parses a device topic into device ID, category and name
+func (tl *topicLayout) parse(topic string) (string, string, string, bool) {
+	values, ok := tl.devices.match(topic)
+	if !ok {
+		return "", "", "", false
+	}
+	for category, segment := range tl.segments {
+		if segment == values["category"] {
+			return values["device"], category, values["name"], true
+		}
+	}
+	return "", "", "", false
+}
+
+// Topic of the bridge itself (status, session)
+func (tl *topicLayout) bridge(name string) string {
+	return tl.prefix + "/" + name
+}
+
+// Home Assistant discovery config topic
+func (tl *topicLayout) discovery(component, id, objectID string) string {
+	return discoveryTopics.fill(map[string]string{
+		"discovery": tl.discoveryPrefix,
+		"component": component,
+		"device":    id,
+		"object":    objectID,
+	})
+}
+
+// Device ID of a Home Assistant discovery config topic of this layout
+func (tl *topicLayout) parseDiscovery(topic string) (string, bool) {
+	values, ok := discoveryTopics.match(topic)
+	if !ok || values["discovery"] != tl.discoveryPrefix {
+		return "", false
+	}
+	return values["device"], true
+}
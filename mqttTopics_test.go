@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestTopicLayout(t *testing.T) {
+	tl := newTopicLayout(configType{
+		TopicPrefix:   "home/heating",
+		TopicSegments: map[string]string{"settings": "config"},
+		TopicTemplate: "{prefix}/{category}/{device}/{name}",
+	})
+
+	topic := tl.device("B123", topicSettings, "Operation", "set")
+	if topic != "home/heating/config/B123/Operation/set" {
+		t.Errorf("topic %s", topic)
+	}
+	if id, category, name, ok := tl.parse(topic); !ok || id != "B123" || category != topicSettings || name != "Operation/set" {
+		t.Errorf("parsed %s %s %s %v", id, category, name, ok)
+	}
+	if filter := tl.device("+", topicSettings, "+", "set"); filter != "home/heating/config/+/+/set" {
+		t.Errorf("filter %s", filter)
+	}
+	for _, other := range []string{
+		"home/heating/settings/B123/Operation",  // default segment name, not in use
+		"other/heating/config/B123/Operation",   // another prefix
+		"home/heating/config/B123",              // no name
+		"homeassistant/sensor/B123/Name/config", // discovery
+	} {
+		if _, _, _, ok := tl.parse(other); ok {
+			t.Errorf("parsed %s", other)
+		}
+	}
+
+	discovery := tl.discovery("sensor", "B123", "Name")
+	if id, ok := tl.parseDiscovery(discovery); !ok || id != "B123" || discoveryDevice(discovery) != "B123" {
+		t.Errorf("discovery %s parsed as %s", discovery, id)
+	}
+	if _, ok := newTopicLayout(configType{DiscoveryPrefix: "ha"}).parseDiscovery(discovery); ok {
+		t.Error("discovery of another prefix parsed")
+	}
+}
+
+func TestTopicTemplateRejected(t *testing.T) {
+	for _, template := range []string{
+		"{prefix}/{device}/{name}/{category}",
+		"{prefix}/{device}/{name}",
+		"{prefix}/{device}/{device}/{category}/{name}",
+		"{prefix}/{site}/{device}/{category}/{name}",
+	} {
+		tl := &topicLayout{prefix: "aquarea", segments: map[string]string{topicSettings: topicSettings}}
+		if err := tl.compile(template); err == nil {
+			t.Errorf("%s accepted", template)
+		}
+	}
+}
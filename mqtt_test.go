@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateProperties(t *testing.T) {
+	am := &aquareaMQTT{topics: newTopicLayout(configType{}), read: make(map[string]time.Time)}
+	read := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	topic := am.topics.device("B123", topicSettings, "Operation")
+	am.read[topic] = read
+	am.read[am.topics.bridge("session")] = read
+
+	properties := am.stateProperties(topic)
+	if properties == nil || properties.user["timestamp"] != "2024-01-02T03:04:05Z" || properties.user["device"] != "B123" {
+		t.Errorf("device topic properties %v", properties)
+	}
+	if properties := am.stateProperties(am.topics.bridge("session")); properties == nil || properties.user["device"] != "" {
+		t.Errorf("bridge topic properties %v", properties)
+	}
+	if properties := am.stateProperties(am.topics.bridge("dropped")); properties != nil {
+		t.Errorf("properties %v without a read time", properties)
+	}
+}
+
+// MQTT client publishing nothing, recording what it was given
+type fakeMQTTClient struct {
+	up        bool
+	published []string // topic=payload
+}
+
+func (c *fakeMQTTClient) publish(topic string, retained bool, payload string, properties *mqttProperties) error {
+	if !c.up {
+		return fmt.Errorf("not connected")
+	}
+	c.published = append(c.published, topic+"="+payload)
+	return nil
+}
+
+func (c *fakeMQTTClient) connected() bool { return c.up }
+func (c *fakeMQTTClient) disconnect()     {}
+
+func newTestMQTT(client mqttClient) *aquareaMQTT {
+	return &aquareaMQTT{
+		mqttClient:        client,
+		topics:            newTopicLayout(configType{}),
+		published:         make(map[string]string),
+		read:              make(map[string]time.Time),
+		retainedDiscovery: make(map[string]bool),
+	}
+}
+
+func TestEventsDeliveredAfterReconnect(t *testing.T) {
+	client := &fakeMQTTClient{}
+	am := newTestMQTT(client)
+	data := newPipeline()
+
+	data.event(map[string]string{"aquarea/B123/events": "first"})
+	data.respond(mqttResponse{request: mqttRequest{responseTopic: "reply"}, payload: "answer"})
+	am.publishPending(data)
+	data.event(map[string]string{"aquarea/B123/events": "second"})
+	am.publishPending(data)
+	if len(client.published) != 0 {
+		t.Fatalf("published %v while disconnected", client.published)
+	}
+
+	client.up = true
+	am.deliver()
+	want := []string{"aquarea/B123/events=first", "aquarea/B123/events=second", "reply=answer"}
+	if fmt.Sprint(client.published) != fmt.Sprint(want) {
+		t.Errorf("published %v, want %v", client.published, want)
+	}
+	am.deliver()
+	if len(client.published) != len(want) {
+		t.Error("delivered twice")
+	}
+}
+
+func TestDecodeBulkCommand(t *testing.T) {
+	request := &mqttRequest{responseTopic: "reply", bulk: true}
+	commands, err := decodeBulkCommand("B123", []byte(`{"OperationMode":"Heat+Tank","TankTargetTemperature":50,"Zone1TargetTemperatureHeat":-2.0}`), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []aquareaCommand{
+		{"B123", "OperationMode", "Heat+Tank", request},
+		{"B123", "TankTargetTemperature", "50", request},
+		{"B123", "Zone1TargetTemperatureHeat", "-2.0", request},
+	}
+	if fmt.Sprint(commands) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v in order", commands, want)
+	}
+
+	for _, payload := range []string{
+		``,
+		`[]`,
+		`"On"`,
+		`{}`,
+		`{"Operation":true}`,
+		`{"Operation":null}`,
+		`{"Operation":{"value":"On"}}`,
+		`{"Operation":"On"`,
+	} {
+		if _, err := decodeBulkCommand("B123", []byte(payload), nil); err == nil {
+			t.Errorf("%s accepted", payload)
+		}
+	}
+}
+
+func TestBulkCommand(t *testing.T) {
+	client := &fakeMQTTClient{up: true}
+	am := newTestMQTT(client)
+	am.commands = newCommandQueue(configType{}, newPipeline())
+	topic := am.topics.device("B123", topicSettings, "set")
+
+	am.handleSubscription(mqttMessage{topic: topic, payload: []byte(`{"Operation":"On","QuietMode":"Level 1"}`)})
+	queued := am.commands.take(time.Now().Add(time.Hour))
+	if len(queued) != 1 || len(queued[0].commands) != 2 {
+		t.Fatalf("queued %v, want both settings for one request", queued)
+	}
+
+	// an invalid bulk command queues nothing, and is answered if asked to
+	am.handleSubscription(mqttMessage{topic: topic, payload: []byte(`{"Operation":true}`), responseTopic: "reply"})
+	if queued := am.commands.take(time.Now().Add(time.Hour)); len(queued) != 0 {
+		t.Errorf("queued %v", queued)
+	}
+	if len(client.published) != 1 || !strings.HasPrefix(client.published[0], `reply={"result":"invalid: `) {
+		t.Errorf("answered %v, want invalid", client.published)
+	}
+}
+
+func TestResultPublishedEveryTime(t *testing.T) {
+	client := &fakeMQTTClient{up: true}
+	am := newTestMQTT(client)
+	result := am.topics.device("B123", topicSettings, "Operation", "result")
+	state := am.topics.device("B123", topicSettings, "Operation")
+
+	for i := 0; i < 2; i++ {
+		am.publishChanges(map[string]string{result: settingApplied, state: "On"}, nil)
+	}
+	want := []string{result + "=" + settingApplied, state + "=On", result + "=" + settingApplied}
+	got := append([]string(nil), client.published...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("published %v, want %v", client.published, want)
+	}
+}
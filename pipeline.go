@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Counts of data which never reached MQTT, published on aquarea/dropped
+type pipelineDrops struct {
+	Values uint64 `json:"values"` // replaced by a newer value of the same topic before being published
+}
+
+// Data left for the MQTT handler since it last took it
+type pipelineBatch struct {
+	values    map[string]string    // topic to latest value not published yet
+	read      map[string]time.Time // when each value was read from Service Cloud
+	status    *bool                // bridge status, if changed
+	discovery *mqttDiscoverySet
+	events    []map[string]string // in the order they happened
+	responses []mqttResponse
+	drops     pipelineDrops
+}
+
+// Hands data from the Aquarea handler to the MQTT handler. Sending never blocks, so that
+// polling and commands go on while the broker is slow or down. Retained values and the bridge
+// status are kept as the latest value, which the MQTT handler takes when notified.
+// Events and command responses are all kept, the MQTT handler holds them until delivered.
+type pipeline struct {
+	notify chan struct{} // something pending in the store
+
+	lock    sync.Mutex
+	pending pipelineBatch
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{
+		notify:  make(chan struct{}, 1),
+		pending: newPipelineBatch(),
+	}
+}
+
+func newPipelineBatch() pipelineBatch {
+	return pipelineBatch{values: make(map[string]string), read: make(map[string]time.Time)}
+}
+
+func (p *pipeline) signal() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+		// already notified
+	}
+}
+
+// Stores retained values for publishing, read from Service Cloud just now
+func (p *pipeline) publish(values map[string]string) {
+	now := time.Now()
+	p.lock.Lock()
+	for topic, value := range values {
+		if _, ok := p.pending.values[topic]; ok {
+			p.pending.drops.Values++
+		}
+		p.pending.values[topic] = value
+		p.pending.read[topic] = now
+	}
+	p.lock.Unlock()
+	p.signal()
+}
+
+func (p *pipeline) setStatus(online bool) {
+	p.lock.Lock()
+	p.pending.status = &online
+	p.lock.Unlock()
+	p.signal()
+}
+
+// Replaces a pending set, keeping its configs of devices the new one could not read
+func (p *pipeline) publishDiscovery(set mqttDiscoverySet) {
+	p.lock.Lock()
+	merged := set.update(p.pending.discovery)
+	p.pending.discovery = &merged
+	p.lock.Unlock()
+	p.signal()
+}
+
+func (p *pipeline) event(event map[string]string) {
+	p.lock.Lock()
+	p.pending.events = append(p.pending.events, event)
+	p.lock.Unlock()
+	p.signal()
+}
+
+func (p *pipeline) respond(response mqttResponse) {
+	p.lock.Lock()
+	p.pending.responses = append(p.pending.responses, response)
+	p.lock.Unlock()
+	p.signal()
+}
+
+// Takes everything pending from the store; drop counts keep adding up
+func (p *pipeline) take() pipelineBatch {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	batch := p.pending
+	p.pending = newPipelineBatch()
+	p.pending.drops = batch.drops
+	return batch
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPipelineKeepsLatestValue(t *testing.T) {
+	p := newPipeline()
+	p.publish(map[string]string{"a": "1", "b": "1"})
+	p.publish(map[string]string{"a": "2"})
+
+	select {
+	case <-p.notify:
+	default:
+		t.Error("not notified")
+	}
+	pending := p.take()
+	if pending.values["a"] != "2" || pending.values["b"] != "1" {
+		t.Errorf("values %v, want a=2 b=1", pending.values)
+	}
+	if pending.read["a"].IsZero() {
+		t.Error("no read time")
+	}
+	if pending.drops.Values != 1 {
+		t.Errorf("%d values dropped, want 1", pending.drops.Values)
+	}
+
+	// drop counts keep adding up, values start over
+	p.publish(map[string]string{"a": "3"})
+	p.publish(map[string]string{"a": "4"})
+	pending = p.take()
+	if len(pending.values) != 1 || pending.drops.Values != 2 {
+		t.Errorf("values %v, %d dropped; want a=4, 2 dropped", pending.values, pending.drops.Values)
+	}
+}
+
+func TestPipelineKeepsAllEvents(t *testing.T) {
+	p := newPipeline()
+	for i := 0; i < 200; i++ {
+		p.event(map[string]string{"events": fmt.Sprint(i)})
+		p.respond(mqttResponse{payload: fmt.Sprint(i)})
+	}
+	pending := p.take()
+	if len(pending.events) != 200 || len(pending.responses) != 200 {
+		t.Fatalf("%d events, %d responses; want 200 each", len(pending.events), len(pending.responses))
+	}
+	for i := range pending.events {
+		if pending.events[i]["events"] != fmt.Sprint(i) || pending.responses[i].payload != fmt.Sprint(i) {
+			t.Fatalf("out of order at %d", i)
+		}
+	}
+	if pending = p.take(); len(pending.events) != 0 || len(pending.responses) != 0 {
+		t.Error("events taken twice")
+	}
+}
+
+func TestPipelineDiscoveryKeepsUnreadDevices(t *testing.T) {
+	p := newPipeline()
+	p.publishDiscovery(mqttDiscoverySet{
+		configs: map[string]string{"homeassistant/sensor/A/x/config": "a", "homeassistant/sensor/B/x/config": "b"},
+		devices: map[string]bool{"A": true, "B": true},
+	})
+	p.publishDiscovery(mqttDiscoverySet{
+		configs: map[string]string{"homeassistant/sensor/A/y/config": "a"},
+		devices: map[string]bool{"A": true, "B": false},
+	})
+	discovery := p.take().discovery
+	if _, ok := discovery.configs["homeassistant/sensor/A/x/config"]; ok {
+		t.Error("config of a device read again kept")
+	}
+	if discovery.configs["homeassistant/sensor/B/x/config"] != "b" || !discovery.devices["B"] {
+		t.Error("config of a device not read dropped")
+	}
+}